@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"got/internal"
+	"got/pkg"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listOptions selects, orders and formats the entries of a listing.
+type listOptions struct {
+	long    bool
+	human   bool
+	all     bool
+	sort    string
+	reverse bool
+	json    bool
+	// recursive lists the subdirectories after their directory as ls -R
+	recursive bool
+}
+
+// listFlags are the flags of listings, -h is the flag of human-readable sizes as in ls.
+var listFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:    "long",
+		Aliases: []string{"l"},
+		Usage:   "list the mode, owner, size and modification time of the entries",
+	},
+	humanReadableFlag("print sizes like 1.5M with --long"),
+	&cli.BoolFlag{
+		Name:    "all",
+		Aliases: []string{"a"},
+		Usage:   "list the entries starting with '.'",
+	},
+	&cli.StringFlag{
+		Name:  "sort",
+		Usage: "sort the entries by `name`, size, time or none",
+		Value: "name",
+	},
+	&cli.BoolFlag{
+		Name:    "reverse",
+		Aliases: []string{"r"},
+		Usage:   "reverse the order of the entries",
+	},
+	&cli.BoolFlag{
+		Name:    "recursive",
+		Aliases: []string{"R"},
+		Usage:   "list the subdirectories after their directory",
+	},
+	&cli.BoolFlag{
+		Name:  "json",
+		Usage: "print the listing as JSON, an object per directory with --recursive",
+	},
+}
+
+// humanReadableFlag returns the flag -h of human-readable sizes described by `usage`.
+func humanReadableFlag(usage string) cli.Flag {
+	return &cli.GenericFlag{
+		Name:    "human-readable",
+		Aliases: []string{"h"},
+		Usage:   usage,
+		Value:   new(humanFlag),
+	}
+}
+
+// humanFlag is the value of --human-readable. urfave/cli shows the help of a command whose
+// flag `h` is true as a bool, a value not printed as a bool keeps -h for sizes as in ls.
+// The value is copied between the names of the flag by its String.
+type humanFlag bool
+
+func (h *humanFlag) Set(s string) error {
+	if s == "set" {
+		*h = true
+		return nil
+	}
+	v, err := strconv.ParseBool(s)
+	*h = humanFlag(v)
+	return err
+}
+
+func (h *humanFlag) String() string {
+	if h != nil && *h {
+		return "set"
+	}
+	return ""
+}
+
+func (h *humanFlag) IsBoolFlag() bool {
+	return true
+}
+
+// listOptionsOf returns the options of a listing selected by the listFlags of `ctx`.
+func listOptionsOf(ctx *cli.Context) (listOptions, error) {
+	options := listOptions{
+		long:      ctx.Bool("long"),
+		human:     humanReadable(ctx),
+		all:       ctx.Bool("all"),
+		sort:      ctx.String("sort"),
+		reverse:   ctx.Bool("reverse"),
+		json:      ctx.Bool("json"),
+		recursive: ctx.Bool("recursive"),
+	}
+	return options, checkSort(options.sort)
+}
+
+// humanReadable reports whether the humanReadableFlag of `ctx` is set.
+func humanReadable(ctx *cli.Context) bool {
+	return bool(*ctx.Generic("human-readable").(*humanFlag))
+}
+
+func checkSort(by string) error {
+	switch by {
+	case "name", "size", "time", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown sort %q, want name, size, time or none", by)
+}
+
+// selectEntries returns the entries of `entries` listed under `options` in their order.
+// Sizes and times sort the largest and newest first as ls.
+func selectEntries(entries []*internal.FileEntry, options listOptions) []*internal.FileEntry {
+	selected := make([]*internal.FileEntry, 0, len(entries))
+	for _, entry := range entries {
+		if options.all || !strings.HasPrefix(entry.Name, ".") {
+			selected = append(selected, entry)
+		}
+	}
+	less := map[string]func(a, b *internal.FileEntry) bool{
+		"name": func(a, b *internal.FileEntry) bool { return a.Name < b.Name },
+		"size": func(a, b *internal.FileEntry) bool {
+			return a.Size > b.Size || (a.Size == b.Size && a.Name < b.Name)
+		},
+		"time": func(a, b *internal.FileEntry) bool {
+			return a.Mtime > b.Mtime || (a.Mtime == b.Mtime && a.Name < b.Name)
+		},
+	}[options.sort]
+	if less != nil {
+		sort.SliceStable(selected, func(i, j int) bool { return less(selected[i], selected[j]) })
+	}
+	if options.reverse {
+		for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+			selected[i], selected[j] = selected[j], selected[i]
+		}
+	}
+	return selected
+}
+
+// jsonEntry is the JSON form of a listing entry.
+type jsonEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Mode  string `json:"mode"`
+	Mtime string `json:"mtime"`
+	Link  string `json:"link,omitempty"`
+	Owner string `json:"owner,omitempty"`
+}
+
+func jsonEntryOf(entry *internal.FileEntry) jsonEntry {
+	return jsonEntry{
+		Name:  entry.Name,
+		Type:  entry.Type,
+		Size:  entry.Size,
+		Mode:  entry.FileMode().String(),
+		Mtime: entry.ModTime().Format(time.RFC3339Nano),
+		Link:  entry.Link,
+		Owner: entry.Owner,
+	}
+}
+
+// printListing prints the entries of directory `dir` to `w` under `options`.
+func printListing(w io.Writer, dir string, entries []*internal.FileEntry, options listOptions) error {
+	entries = selectEntries(entries, options)
+	if options.json {
+		listing := struct {
+			Dir     string      `json:"dir"`
+			Entries []jsonEntry `json:"entries"`
+		}{Dir: dir, Entries: make([]jsonEntry, 0, len(entries))}
+		for _, entry := range entries {
+			listing.Entries = append(listing.Entries, jsonEntryOf(entry))
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listing)
+	}
+
+	fmt.Fprintf(w, "%s:\n", dir)
+	if !options.long {
+		for _, entry := range entries {
+			fmt.Fprintln(w, displayName(entry, false))
+		}
+		fmt.Fprintln(w, "count:", len(entries))
+		return nil
+	}
+
+	// columns are as wide as their widest value, names are never cut
+	sizes := make([]string, len(entries))
+	var ownerWidth, sizeWidth int
+	for i, entry := range entries {
+		if options.human {
+			sizes[i] = pkg.HumanSize(entry.Size)
+		} else {
+			sizes[i] = strconv.FormatInt(entry.Size, 10)
+		}
+		if len(sizes[i]) > sizeWidth {
+			sizeWidth = len(sizes[i])
+		}
+		if len(entry.Owner) > ownerWidth {
+			ownerWidth = len(entry.Owner)
+		}
+	}
+	for i, entry := range entries {
+		fmt.Fprintf(w, "%s  %-*s  %*s  %s  %s\n", entry.FileMode(), ownerWidth, entry.Owner, sizeWidth, sizes[i],
+			entry.ModTime().Format("2006-01-02 15:04"), displayName(entry, true))
+	}
+	fmt.Fprintln(w, "count:", len(entries))
+	return nil
+}
+
+// jsonStat is the JSON form of the status of a path.
+type jsonStat struct {
+	Path string `json:"path"`
+	jsonEntry
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// printStats prints the status of remote paths `stats` to `w`, as a JSON array if `asJSON`.
+func printStats(w io.Writer, stats []internal.FileStat, asJSON bool) error {
+	if asJSON {
+		list := make([]jsonStat, 0, len(stats))
+		for _, stat := range stats {
+			list = append(list, jsonStat{Path: stat.Path, jsonEntry: jsonEntryOf(stat.FileEntry), Checksum: stat.Checksum})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+	for i, stat := range stats {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "path:     %s\n", stat.Path)
+		fmt.Fprintf(w, "type:     %s\n", stat.Type)
+		fmt.Fprintf(w, "size:     %d\n", stat.Size)
+		fmt.Fprintf(w, "mode:     %s\n", stat.FileMode())
+		if stat.Owner != "" {
+			fmt.Fprintf(w, "owner:    %s\n", stat.Owner)
+		}
+		fmt.Fprintf(w, "mtime:    %s\n", stat.ModTime().Format("2006-01-02 15:04:05.000000000 -0700"))
+		if stat.Link != "" {
+			fmt.Fprintf(w, "link:     %s\n", stat.Link)
+		}
+		if stat.Checksum != "" {
+			fmt.Fprintf(w, "checksum: %s\n", stat.Checksum)
+		}
+	}
+	return nil
+}
+
+// printWalk prints the listing of each directory of `walker` to `w` under `options`, the
+// directories which cannot be read are reported on stderr.
+func printWalk(w io.Writer, walker internal.DirWalker, options listOptions) error {
+	defer walker.Close()
+	for listed := false; ; {
+		listing, err := walker.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if listing.Err != nil {
+			fmt.Fprintf(os.Stderr, "cannot read %s: %v\n", listing.Dir, listing.Err)
+			continue
+		}
+		if listed && !options.json {
+			fmt.Fprintln(w)
+		}
+		if err = printListing(w, listing.Dir, listing.Entries, options); err != nil {
+			return err
+		}
+		listed = true
+	}
+}
+
+// displayName returns the name of `entry` marked '/' if a directory, followed by the target
+// of a symlink if `long`.
+func displayName(entry *internal.FileEntry, long bool) string {
+	switch {
+	case entry.IsDir():
+		return entry.Name + "/"
+	case long && entry.Link != "":
+		return entry.Name + " -> " + entry.Link
+	}
+	return entry.Name
+}
+
+// localListing returns local directory `dir` made absolute and its entries.
+func localListing(dir string) (string, []*internal.FileEntry, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	entries := make([]*internal.FileEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if os.IsNotExist(err) {
+			// removed since read
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+		entries = append(entries, internal.NewFileEntry(dir, info))
+	}
+	return dir, entries, nil
+}
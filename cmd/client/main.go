@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"got/internal"
+	"got/pkg"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -20,10 +24,9 @@ func main() {
 	app.Usage = "got is a simply tool for upload file to remote server"
 	app.Flags = []cli.Flag{
 		&cli.StringFlag{
-			Name:     "addr, a",
-			Aliases:  []string{"a"},
-			Usage:    "Got server address",
-			Required: true,
+			Name:    "addr, a",
+			Aliases: []string{"a"},
+			Usage:   "Got server address, arguments like host:path address their own server",
 		},
 		&cli.BoolFlag{
 			Name:     "time, t",
@@ -32,6 +35,58 @@ func main() {
 			Value:    false,
 			Required: false,
 		},
+		&cli.BoolFlag{
+			Name:  "checksum",
+			Usage: "print checksum of transferred data",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:  "checksum-algorithm",
+			Value: pkg.DefaultChecksumAlgorithm,
+			Usage: "checksum algorithm for verifying transfers, one of " + strings.Join(pkg.ChecksumAlgorithms(), ", "),
+		},
+		&cli.StringFlag{
+			Name:  "chunk-size",
+			Value: pkg.FormatSize(internal.DefaultChunkSize),
+			Usage: "data size of upload messages like 64K or 1M, auto grows it while the throughput improves",
+		},
+		&cli.StringFlag{
+			Name:  "max-message-size",
+			Value: pkg.FormatSize(internal.DefaultMaxMessageSize),
+			Usage: "max size of gRPC messages, chunks are bounded by the smaller max of both sides",
+		},
+		&cli.StringFlag{
+			Name:  "compress",
+			Value: internal.CompressionNone,
+			Usage: "compress transferred data, one of none, auto, " + strings.Join(pkg.CompressionAlgorithms(), ", ") +
+				", auto skips already compressed files",
+		},
+		&cli.StringFlag{
+			Name:  "ca",
+			Usage: "CA certificate for verifying the server, the server fingerprint is pinned on first use if not specified",
+		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "client certificate for servers requiring mutual TLS",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "private key of the client certificate",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			EnvVars: []string{"GOT_TOKEN"},
+			Usage:   "bearer token for servers requiring token authentication",
+		},
+		&cli.StringFlag{
+			Name:  "known-hosts",
+			Usage: "file of pinned server fingerprints (default: got/known_hosts in the user config directory)",
+		},
+		&cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "disable TLS, data are transferred in plaintext",
+			Value: false,
+		},
 	}
 	app.Commands = []*cli.Command{
 		{
@@ -39,6 +94,10 @@ func main() {
 			Aliases: []string{"l", "ls", "ll"},
 			Usage:   "list remote directory content",
 			Action:  list,
+			Flags:   listFlags,
+			// -h is the flag of human-readable sizes, `got help list` prints the help
+			HideHelp:               true,
+			UseShortOptionHandling: true,
 		},
 		{
 			Name:    "change",
@@ -47,29 +106,398 @@ func main() {
 			Action:  change,
 		},
 		{
-			Name:    "upload",
-			Aliases: []string{"u", "up"},
-			Usage:   "upload file to remote directory",
-			Action:  upload,
+			Name:      "tree",
+			Usage:     "list a remote directory and its subdirectories as a tree",
+			ArgsUsage: "[dir]",
+			Action:    tree,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "all",
+					Aliases: []string{"a"},
+					Usage:   "list the entries starting with '.'",
+				},
+				&cli.IntFlag{
+					Name:    "level",
+					Aliases: []string{"L"},
+					Usage:   "descend at most N levels, all if 0",
+				},
+			},
+			UseShortOptionHandling: true,
+		},
+		{
+			Name:      "stat",
+			Usage:     "print the type, size, mode, owner and modification time of remote paths",
+			ArgsUsage: "<path>...",
+			Action:    stat,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "dereference",
+					Aliases: []string{"L"},
+					Usage:   "print the target of a symlink instead of the symlink",
+				},
+				&cli.BoolFlag{
+					Name:  "checksum",
+					Usage: "print the checksum of files, computed by the server with --checksum-algorithm",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the status as a JSON array",
+				},
+			},
+		},
+		{
+			Name:      "du",
+			Usage:     "print the total size of the files under remote directories",
+			ArgsUsage: "[dir]...",
+			Action:    diskUsage,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:    "max-depth",
+					Aliases: []string{"d"},
+					Usage:   "print the directories at most N levels below the arguments, all if negative",
+					Value:   -1,
+				},
+				&cli.BoolFlag{
+					Name:    "summarize",
+					Aliases: []string{"s"},
+					Usage:   "print only the total of each argument, as --max-depth 0",
+				},
+				humanReadableFlag("print sizes like 1.5M"),
+			},
+			// -h is the flag of human-readable sizes as in list
+			HideHelp:               true,
+			UseShortOptionHandling: true,
+		},
+		{
+			Name:      "df",
+			Usage:     "print the space of the filesystem of the server root",
+			ArgsUsage: "[path]",
+			Action:    diskFree,
+			Flags: []cli.Flag{
+				humanReadableFlag("print sizes like 1.5G"),
+			},
+			HideHelp: true,
+		},
+		{
+			Name:      "upload",
+			Aliases:   []string{"u", "up", "put"},
+			Usage:     "upload file to remote directory, standard input as - to the file named by the destination",
+			ArgsUsage: "<file>... [[host:]destination] | - <[host:]file>",
+			Action:    upload,
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "resume",
+					Usage: "resume an interrupted upload of the same file",
+					Value: false,
+				},
+				&cli.IntFlag{
+					Name:  "parallel",
+					Usage: "upload a large file over N concurrent streams",
+					Value: 1,
+				},
+				&cli.BoolFlag{
+					Name:  "tar",
+					Usage: "transfer a directory as a single tar stream instead of file by file",
+				},
+			}, append(transferFlags, conflictFlags...)...),
+		},
+		{
+			Name:      "download",
+			Aliases:   []string{"d", "down"},
+			Usage:     "download file from remote directory",
+			ArgsUsage: "<[host:]file or pattern>... [destination]",
+			Action:    download,
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "resume",
+					Usage: "resume an interrupted download of the same file",
+					Value: false,
+				},
+				&cli.IntFlag{
+					Name:  "parallel",
+					Usage: "download a large file over N concurrent streams",
+					Value: 1,
+				},
+				&cli.BoolFlag{
+					Name:  "tar",
+					Usage: "transfer a directory as a single tar stream instead of file by file",
+				},
+			}, append(transferFlags, conflictFlags...)...),
 		},
 		{
-			Name:    "download",
-			Aliases: []string{"d", "down"},
-			Usage:   "download file from remote directory",
-			Action:  download,
+			Name:      "remove",
+			Aliases:   []string{"rm"},
+			Usage:     "remove remote files or directories",
+			ArgsUsage: "<path>...",
+			Action:    remove,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"r"},
+					Usage:   "remove directories with their content",
+				},
+			},
+		},
+		{
+			Name:      "mkdir",
+			Usage:     "create remote directories",
+			ArgsUsage: "<dir>...",
+			Action:    makeDir,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "parents",
+					Aliases: []string{"p"},
+					Usage:   "create the missing parents, an existing directory is no error",
+				},
+			},
+		},
+		{
+			Name:      "move",
+			Aliases:   []string{"mv"},
+			Usage:     "move or rename a remote file or directory",
+			ArgsUsage: "<source> <destination>",
+			Action:    move,
+			Flags:     conflictFlags,
+		},
+		{
+			Name:      "cat",
+			Usage:     "write remote files to standard output, without progress",
+			ArgsUsage: "<[host:]file>...",
+			Action:    cat,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "offset",
+					Usage: "start at byte `N` of each file, like 512 or 1M",
+					Value: "0",
+				},
+				&cli.StringFlag{
+					Name:  "length",
+					Usage: "write at most `N` bytes of each file, up to the end if 0",
+					Value: "0",
+				},
+			},
+		},
+		{
+			Name:      "copy",
+			Aliases:   []string{"cp"},
+			Usage:     "copy a file or directory on the server, or between client and server as host:path",
+			ArgsUsage: "<source> <destination>",
+			Action:    copyRemote,
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"r"},
+					Usage:   "copy directories with their content on the server, copies between client and server always do",
+				},
+			}, append(transferFlags, conflictFlags...)...),
+		},
+		{
+			Name:   "shell",
+			Usage:  "run commands interactively over one connection, or from standard input",
+			Action: runShell,
+		},
+		{
+			Name:      "sync",
+			Usage:     "mirror a directory to or from the server, the remote one as host:path or :path",
+			ArgsUsage: "<source> <destination>",
+			Action:    syncDirs,
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "delete",
+					Usage: "delete files of the destination which are not in the source",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the planned actions without doing them",
+				},
+				&cli.StringFlag{
+					Name:  "compare",
+					Usage: "compare files of the same size by `mtime` or checksum",
+					Value: "mtime",
+				},
+			}, transferFlags...),
 		},
 	}
 	err := app.Run(os.Args)
 	if err != nil {
-		fmt.Println(err)
+		// errors are kept out of data written to stdout, as by got cat
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+var transferFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "workers",
+		Usage: "transfer the files of a directory over N concurrent streams",
+		Value: internal.DefaultWorkers,
+	},
+	&cli.BoolFlag{
+		Name:  "continue-on-error",
+		Usage: "keep transferring the files of a directory after one failed",
+	},
+	&cli.BoolFlag{
+		Name:  "delta",
+		Usage: "transfer only the changed blocks of files whose destination exists",
+	},
+}
+
+var conflictFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  string(internal.ConflictOverwrite),
+		Usage: "overwrite an existing destination (default)",
+	},
+	&cli.BoolFlag{
+		Name:  string(internal.ConflictSkip),
+		Usage: "skip the transfer if the destination exists",
+	},
+	&cli.BoolFlag{
+		Name:  string(internal.ConflictRename),
+		Usage: "save as `name (1).ext` if the destination exists",
+	},
+	&cli.BoolFlag{
+		Name:  string(internal.ConflictFail),
+		Usage: "fail if the destination exists",
+	},
+}
+
+// conflictPolicy returns the policy selected by the conflict flags, at most one may be set.
+func conflictPolicy(ctx *cli.Context) (internal.ConflictPolicy, error) {
+	var policy internal.ConflictPolicy
+	for _, flag := range conflictFlags {
+		name := flag.Names()[0]
+		if !ctx.Bool(name) {
+			continue
+		}
+		if policy != "" {
+			return "", fmt.Errorf("--%s and --%s are exclusive", policy, name)
+		}
+		policy = internal.ConflictPolicy(name)
+	}
+	return internal.ParseConflictPolicy(string(policy))
+}
+
+// transferOptions returns the options of an upload or download selected by its flags.
+func transferOptions(ctx *cli.Context) (internal.TransferOptions, error) {
+	conflict, err := conflictPolicy(ctx)
+	if err != nil {
+		return internal.TransferOptions{}, err
+	}
+	options := internal.TransferOptions{
+		Resume:          ctx.Bool("resume"),
+		Conflict:        conflict,
+		Parallel:        ctx.Int("parallel"),
+		Tar:             ctx.Bool("tar"),
+		Workers:         ctx.Int("workers"),
+		ContinueOnError: ctx.Bool("continue-on-error"),
+		Delta:           ctx.Bool("delta"),
+	}
+	if options.Parallel < 1 {
+		return internal.TransferOptions{}, errors.New("--parallel must be at least 1")
+	}
+	if options.Workers < 1 {
+		return internal.TransferOptions{}, errors.New("--workers must be at least 1")
+	}
+	if options.Resume && options.Parallel > 1 {
+		return internal.TransferOptions{}, errors.New("--resume and --parallel are exclusive")
+	}
+	if options.Delta && (options.Resume || options.Parallel > 1) {
+		return internal.TransferOptions{}, errors.New("--delta is exclusive with --resume and --parallel")
+	}
+	return options, nil
+}
+
+func printResult(ctx *cli.Context, filePath string, result internal.TransferResult) {
+	if result.Skipped {
+		fmt.Printf("\nskip %s: %s already exists\n", filePath, result.Path)
+		return
+	}
+	if result.Path != "" && filepath.Base(result.Path) != filepath.Base(filePath) {
+		fmt.Printf("\nsaved as %s\n", result.Path)
+	}
+	if result.Files > 0 || result.Unchanged > 0 || len(result.Failed) > 0 {
+		fmt.Printf("\n%d files transferred, %d unchanged, %d failed\n",
+			result.Files, result.Unchanged, len(result.Failed))
+	}
+	for _, failed := range result.Failed {
+		fmt.Printf("failed %s: %v\n", failed.Path, failed.Err)
+	}
+	if ctx.Bool("checksum") && result.Checksum != "" {
+		fmt.Printf("\n%s  %s\n", result.Checksum, filePath)
+	}
+}
+
+// printBatch prints the outcome of each transfer of a batch and their summary.
+func printBatch(ctx *cli.Context, items []internal.BatchItem) {
+	if len(items) == 0 {
 		return
 	}
+	// the progress bar leaves the cursor on its line
+	fmt.Println()
+	var skipped, failed int
+	for _, item := range items {
+		result := item.Result
+		switch {
+		case item.Err != nil:
+			failed++
+			fmt.Printf("failed %s: %v\n", item.Path, item.Err)
+		case result.Skipped:
+			skipped++
+			fmt.Printf("skip %s: %s already exists\n", item.Path, result.Path)
+		case ctx.Bool("checksum") && result.Checksum != "":
+			fmt.Printf("%s  %s\n", result.Checksum, item.Path)
+		}
+		for _, f := range result.Failed {
+			fmt.Printf("failed %s: %v\n", path.Join(filepath.ToSlash(item.Path), f.Path), f.Err)
+		}
+	}
+	fmt.Printf("%d transferred, %d skipped, %d failed\n", len(items)-skipped-failed, skipped, failed)
 }
 
 func createClient(ctx *cli.Context) (internal.GotClient, error) {
-	addr := ctx.String("addr")
+	return connect(ctx, "")
+}
+
+// connect creates a client of server `addr`, the server of --addr if empty.
+func connect(ctx *cli.Context, addr string) (internal.GotClient, error) {
+	if addr == "" {
+		addr = ctx.String("addr")
+	}
+	if addr == "" {
+		return nil, errors.New("no server address, set --addr or address the server as host:path")
+	}
 	addr = parseAddr(addr)
-	return internal.CreateClient(addr)
+
+	chunkSize, adaptive, err := internal.ParseChunkSize(ctx.String("chunk-size"))
+	if err != nil {
+		return nil, err
+	}
+	maxMessageSize, err := pkg.ParseSize(ctx.String("max-message-size"))
+	if err != nil {
+		return nil, err
+	}
+	config := internal.ClientConfig{
+		CAFile:            ctx.String("ca"),
+		CertFile:          ctx.String("cert"),
+		KeyFile:           ctx.String("key"),
+		Token:             ctx.String("token"),
+		ChecksumAlgorithm: ctx.String("checksum-algorithm"),
+		Compression:       ctx.String("compress"),
+		ChunkSize:         chunkSize,
+		AdaptiveChunkSize: adaptive,
+		MaxMessageSize:    int(maxMessageSize),
+		KnownHostsFile:    ctx.String("known-hosts"),
+		Insecure:          ctx.Bool("insecure"),
+	}
+	dir, err := internal.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	if config.KnownHostsFile == "" {
+		config.KnownHostsFile = filepath.Join(dir, "known_hosts")
+	}
+	config.SessionsFile = filepath.Join(dir, "sessions")
+	return internal.CreateClient(addr, config)
 }
 
 func parseAddr(addr string) string {
@@ -87,16 +515,165 @@ func parseAddr(addr string) string {
 func list(ctx *cli.Context) error {
 	now := time.Now()
 
+	options, err := listOptionsOf(ctx)
+	if err != nil {
+		return err
+	}
 	gotClient, err := createClient(ctx)
 	if err != nil {
 		return err
 	}
 
-	filesInfo, err := gotClient.ListFiles()
+	if options.recursive {
+		walker, err := gotClient.Walk(ctx.Args().First(), 0, options.all)
+		if err != nil {
+			return err
+		}
+		if err = printWalk(os.Stdout, walker, options); err != nil {
+			return err
+		}
+	} else {
+		dir, entries, err := gotClient.ListFiles(ctx.Args().First())
+		if err != nil {
+			return err
+		}
+		if err = printListing(os.Stdout, dir, entries, options); err != nil {
+			return err
+		}
+	}
+
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+func tree(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.Int("level") < 0 {
+		return errors.New("--level must not be negative")
+	}
+	gotClient, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	walker, err := gotClient.Walk(ctx.Args().First(), ctx.Int("level"), ctx.Bool("all"))
+	if err != nil {
+		return err
+	}
+	if err = printTree(os.Stdout, walker, ctx.Int("level")); err != nil {
+		return err
+	}
+
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+func stat(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.NArg() == 0 {
+		return errors.New("usage: got stat [--json] <path>...")
+	}
+	gotClient, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	options := internal.StatOptions{Follow: ctx.Bool("dereference"), Checksum: ctx.Bool("checksum")}
+	stats, err := statPaths(gotClient, ctx.Args().Slice(), options)
+	if len(stats) > 0 {
+		if printErr := printStats(os.Stdout, stats, ctx.Bool("json")); printErr != nil {
+			return printErr
+		}
+	}
 	if err != nil {
 		return err
 	}
-	fmt.Println(filesInfo)
+
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+// statPaths returns the status of remote paths `names`, those which fail are reported on
+// stderr unless the only one.
+func statPaths(gotClient internal.GotClient, names []string, options internal.StatOptions) ([]internal.FileStat, error) {
+	stats := make([]internal.FileStat, 0, len(names))
+	var failed int
+	for _, name := range names {
+		stat, err := gotClient.Stat(name, options)
+		if err != nil {
+			if len(names) == 1 {
+				return nil, err
+			}
+			failed++
+			fmt.Fprintf(os.Stderr, "cannot stat %s: %v\n", name, err)
+			continue
+		}
+		stats = append(stats, stat)
+	}
+	if failed > 0 {
+		return stats, fmt.Errorf("%d of %d paths failed", failed, len(names))
+	}
+	return stats, nil
+}
+
+func diskUsage(ctx *cli.Context) error {
+	now := time.Now()
+
+	maxDepth := ctx.Int("max-depth")
+	if ctx.Bool("summarize") {
+		maxDepth = 0
+	}
+	gotClient, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	dirs := ctx.Args().Slice()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		// hidden files take space too
+		walker, err := gotClient.Walk(dir, 0, true)
+		if err != nil {
+			return err
+		}
+		if err = printDiskUsage(os.Stdout, walker, dir, maxDepth, humanReadable(ctx)); err != nil {
+			return err
+		}
+	}
+
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+func diskFree(ctx *cli.Context) error {
+	now := time.Now()
+
+	gotClient, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	space, err := gotClient.DiskSpace(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	printDiskSpace(os.Stdout, space, humanReadable(ctx))
 
 	cost := time.Since(now)
 	if ctx.Bool("time") {
@@ -114,11 +691,13 @@ func change(ctx *cli.Context) error {
 	}
 
 	dstDir := ctx.Args().First()
-	dirInfo, err := gotClient.ChangeDir(dstDir)
+	dir, entries, err := gotClient.ChangeDir(dstDir)
 	if err != nil {
 		return err
 	}
-	fmt.Println(dirInfo)
+	if err = printListing(os.Stdout, dir, entries, listOptions{sort: "name"}); err != nil {
+		return err
+	}
 
 	cost := time.Since(now)
 	if ctx.Bool("time") {
@@ -130,16 +709,199 @@ func change(ctx *cli.Context) error {
 func upload(ctx *cli.Context) error {
 	now := time.Now()
 
+	if ctx.NArg() == 0 {
+		return errors.New("usage: got upload <file>... [[host:]destination]")
+	}
+	// the last of several arguments is the remote destination, the others are local files.
+	// Standard input is uploaded as `-`, the destination names the file it is saved as
+	args := ctx.Args().Slice()
+	var dst remoteArg
+	if args[0] == "-" && len(args) != 2 {
+		return errors.New("usage: got upload - <[host:]file>")
+	}
+	if len(args) > 1 {
+		dst, args = remoteArgOf(args[len(args)-1]), args[:len(args)-1]
+	}
+	for i, arg := range args {
+		if _, ok := parseRemoteArg(arg); ok {
+			return fmt.Errorf("%s is remote, only the destination can be, write ./%[1]s for a local file", arg)
+		} else if arg == "-" && i > 0 {
+			return errors.New("standard input is uploaded alone, as got upload - <[host:]file>")
+		}
+		args[i] = filepath.Clean(arg)
+	}
+	options, err := transferOptions(ctx)
+	if err != nil {
+		return err
+	}
+	gotClient, err := connect(ctx, dst.addr)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "-" {
+		result, err := gotClient.UploadReader(os.Stdin, dst.path, options)
+		printResult(ctx, dst.path, result)
+		if err != nil {
+			return err
+		}
+	} else if len(args) == 1 {
+		result, err := gotClient.UploadFile(args[0], dst.path, options)
+		// the files of a directory which failed are listed before the error
+		printResult(ctx, args[0], result)
+		if err != nil {
+			return err
+		}
+	} else {
+		items, err := gotClient.UploadFiles(args, dst.path, options)
+		printBatch(ctx, items)
+		if err != nil {
+			return err
+		}
+	}
+
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+func download(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.NArg() == 0 {
+		return errors.New("usage: got download <[host:]file or pattern>... [destination]")
+	}
+	// the destination is the last of several arguments if local, the others are remote
+	args := ctx.Args().Slice()
+	var dst string
+	if _, ok := parseRemoteArg(args[len(args)-1]); !ok && len(args) > 1 {
+		dst, args = args[len(args)-1], args[:len(args)-1]
+	}
+	var server remoteArg
+	paths := make([]string, len(args))
+	for i, arg := range args {
+		src := remoteArgOf(arg)
+		addr, err := sameServer(server, src)
+		if err != nil {
+			return err
+		}
+		server.addr, paths[i] = addr, remotePath(src.path)
+	}
+	options, err := transferOptions(ctx)
+	if err != nil {
+		return err
+	}
+	gotClient, err := connect(ctx, server.addr)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 1 && !internal.IsPattern(paths[0]) {
+		result, err := gotClient.DownloadFile(paths[0], dst, options)
+		// the files of a directory which failed are listed before the error
+		printResult(ctx, paths[0], result)
+		if err != nil {
+			return err
+		}
+	} else {
+		// patterns are matched by the server
+		items, err := gotClient.DownloadFiles(paths, dst, options)
+		printBatch(ctx, items)
+		if err != nil {
+			return err
+		}
+	}
+
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+func cat(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.NArg() == 0 {
+		return errors.New("usage: got cat [--offset N] [--length N] <[host:]file>...")
+	}
+	offset, err := pkg.ParseSize(ctx.String("offset"))
+	if err != nil {
+		return err
+	}
+	length, err := pkg.ParseSize(ctx.String("length"))
+	if err != nil {
+		return err
+	}
+	var server remoteArg
+	paths := make([]string, ctx.NArg())
+	for i, arg := range ctx.Args().Slice() {
+		src := remoteArgOf(arg)
+		addr, err := sameServer(server, src)
+		if err != nil {
+			return err
+		}
+		server.addr, paths[i] = addr, remotePath(src.path)
+	}
+	gotClient, err := connect(ctx, server.addr)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if _, err = gotClient.ReadRange(p, offset, length, os.Stdout); err != nil {
+			return err
+		}
+	}
+
+	// the cost goes to stderr, stdout is the data
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Fprintf(os.Stderr, "cost: %s\n", cost)
+	}
+	return nil
+}
+
+func remove(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.NArg() == 0 {
+		return errors.New("usage: got remove [-r] <path>...")
+	}
 	gotClient, err := createClient(ctx)
 	if err != nil {
 		return err
 	}
+	for _, name := range ctx.Args().Slice() {
+		if err = gotClient.Remove(name, ctx.Bool("recursive")); err != nil {
+			return err
+		}
+	}
 
-	filePath := filepath.Clean(ctx.Args().First())
-	err = gotClient.UploadFile(filePath)
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+func makeDir(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.NArg() == 0 {
+		return errors.New("usage: got mkdir [-p] <dir>...")
+	}
+	gotClient, err := createClient(ctx)
 	if err != nil {
 		return err
 	}
+	for _, name := range ctx.Args().Slice() {
+		if err = gotClient.MakeDir(name, ctx.Bool("parents")); err != nil {
+			return err
+		}
+	}
 
 	cost := time.Since(now)
 	if ctx.Bool("time") {
@@ -148,16 +910,67 @@ func upload(ctx *cli.Context) error {
 	return nil
 }
 
-func download(ctx *cli.Context) error {
+func move(ctx *cli.Context) error {
 	now := time.Now()
 
+	if ctx.NArg() != 2 {
+		return errors.New("usage: got move <source> <destination>")
+	}
+	conflict, err := conflictPolicy(ctx)
+	if err != nil {
+		return err
+	}
 	gotClient, err := createClient(ctx)
 	if err != nil {
 		return err
 	}
+	destination := ctx.Args().Get(1)
+	result, err := gotClient.Rename(ctx.Args().Get(0), destination, conflict)
+	if err != nil {
+		return err
+	}
+	printResult(ctx, destination, result)
 
-	filePath := filepath.Clean(ctx.Args().First())
-	err = gotClient.DownloadFile(filePath)
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+// copyRemote copies a file or directory on the server, or uploads or downloads it if
+// exactly one of source and destination is addressed as host:path or :path.
+func copyRemote(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.NArg() != 2 {
+		return errors.New("usage: got copy [-r] <source> <destination>")
+	}
+	conflict, err := conflictPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	source, sourceRemote := parseRemoteArg(ctx.Args().Get(0))
+	destination, destinationRemote := parseRemoteArg(ctx.Args().Get(1))
+	if sourceRemote != destinationRemote {
+		options := internal.TransferOptions{
+			Conflict:        conflict,
+			Parallel:        1,
+			Workers:         ctx.Int("workers"),
+			ContinueOnError: ctx.Bool("continue-on-error"),
+			Delta:           ctx.Bool("delta"),
+		}
+		if options.Workers < 1 {
+			return errors.New("--workers must be at least 1")
+		}
+		if destinationRemote {
+			err = copyUp(ctx, filepath.Clean(ctx.Args().Get(0)), destination, options)
+		} else {
+			err = copyDown(ctx, source, ctx.Args().Get(1), options)
+		}
+	} else {
+		err = copyOnServer(ctx, remoteArgOf(ctx.Args().Get(0)), remoteArgOf(ctx.Args().Get(1)), conflict)
+	}
 	if err != nil {
 		return err
 	}
@@ -168,3 +981,147 @@ func download(ctx *cli.Context) error {
 	}
 	return nil
 }
+
+// copyOnServer copies `source` to `destination` on their server.
+func copyOnServer(ctx *cli.Context, source remoteArg, destination remoteArg, conflict internal.ConflictPolicy) error {
+	addr, err := sameServer(source, destination)
+	if err != nil {
+		return err
+	}
+	gotClient, err := connect(ctx, addr)
+	if err != nil {
+		return err
+	}
+	result, err := gotClient.Copy(source.path, destination.path, ctx.Bool("recursive"), conflict)
+	if err != nil {
+		return err
+	}
+	printResult(ctx, destination.path, result)
+	return nil
+}
+
+// copyUp uploads local `filePath` to `destination`, a directory with its content as by scp -r.
+func copyUp(ctx *cli.Context, filePath string, destination remoteArg, options internal.TransferOptions) error {
+	gotClient, err := connect(ctx, destination.addr)
+	if err != nil {
+		return err
+	}
+	result, err := gotClient.UploadFile(filePath, destination.path, options)
+	// the files of a directory which failed are listed before the error
+	printResult(ctx, filePath, result)
+	return err
+}
+
+// copyDown downloads `source` to local `dst`, a directory with its content as by scp -r.
+func copyDown(ctx *cli.Context, source remoteArg, dst string, options internal.TransferOptions) error {
+	gotClient, err := connect(ctx, source.addr)
+	if err != nil {
+		return err
+	}
+	filePath := remotePath(source.path)
+	result, err := gotClient.DownloadFile(filePath, dst, options)
+	// the files of a directory which failed are listed before the error
+	printResult(ctx, filePath, result)
+	return err
+}
+
+// syncArgs returns the local and remote directories of a sync and whether it pulls the
+// remote one, exactly one of `source` and `destination` is remote, as host:path or :path.
+func syncArgs(source string, destination string) (string, remoteArg, bool, error) {
+	remoteSource, sourceIsRemote := parseRemoteArg(source)
+	remoteDestination, destinationIsRemote := parseRemoteArg(destination)
+	if sourceIsRemote == destinationIsRemote || source == "" || destination == "" {
+		return "", remoteArg{}, false, errors.New("one of source and destination must be remote, as host:path or :path")
+	}
+	if sourceIsRemote {
+		remoteSource.path = remotePath(remoteSource.path)
+		return filepath.Clean(destination), remoteSource, true, nil
+	}
+	remoteDestination.path = remotePath(remoteDestination.path)
+	return filepath.Clean(source), remoteDestination, false, nil
+}
+
+// remotePath returns remote path `p` cleaned, the current remote directory if empty.
+func remotePath(p string) string {
+	return path.Clean(filepath.ToSlash(p))
+}
+
+func syncDirs(ctx *cli.Context) error {
+	now := time.Now()
+
+	if ctx.NArg() != 2 {
+		return errors.New("usage: got sync <source> <destination>")
+	}
+	localPath, remote, pull, err := syncArgs(ctx.Args().Get(0), ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	options := internal.SyncOptions{
+		Pull:   pull,
+		Delete: ctx.Bool("delete"),
+		DryRun: ctx.Bool("dry-run"),
+		Transfer: internal.TransferOptions{
+			Workers:         ctx.Int("workers"),
+			ContinueOnError: ctx.Bool("continue-on-error"),
+			Delta:           ctx.Bool("delta"),
+		},
+	}
+	switch ctx.String("compare") {
+	case "mtime":
+	case "checksum":
+		options.Checksum = true
+	default:
+		return fmt.Errorf("unknown --compare %q, want mtime or checksum", ctx.String("compare"))
+	}
+	if options.Transfer.Workers < 1 {
+		return errors.New("--workers must be at least 1")
+	}
+
+	gotClient, err := connect(ctx, remote.addr)
+	if err != nil {
+		return err
+	}
+	result, err := gotClient.Sync(localPath, remote.path, options)
+	// the entries which failed are listed before the error
+	if err == nil || len(result.Actions) > 0 {
+		printSync(result, options.DryRun)
+	}
+	if err != nil {
+		return err
+	}
+
+	cost := time.Since(now)
+	if ctx.Bool("time") {
+		fmt.Printf("cost: %s\n", cost)
+	}
+	return nil
+}
+
+func printSync(result internal.SyncResult, dryRun bool) {
+	var deleted int
+	for _, action := range result.Actions {
+		if action.Action == internal.SyncDelete {
+			deleted++
+		}
+		if !dryRun {
+			continue
+		}
+		if action.Action == internal.SyncCopy {
+			fmt.Printf("%-6s %s (%s)\n", action.Action, action.Path, pkg.FormatSize(action.Size))
+		} else {
+			fmt.Printf("%-6s %s\n", action.Action, action.Path)
+		}
+	}
+	if dryRun {
+		fmt.Printf("%d actions planned, nothing done (dry run)\n", len(result.Actions))
+		return
+	}
+	if len(result.Actions) == 0 {
+		fmt.Println("already in sync")
+		return
+	}
+	fmt.Printf("\n%d files transferred, %d deleted, %d failed\n", result.Files, deleted, len(result.Failed))
+	for _, failed := range result.Failed {
+		fmt.Printf("failed %s: %v\n", failed.Path, failed.Err)
+	}
+}
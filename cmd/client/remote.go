@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// remoteArg is an argument addressing a path on a server as scp does,
+// `[user@]host[:port]:path`, or `:path` on the server of --addr.
+type remoteArg struct {
+	// addr is the server, the one of --addr if empty
+	addr string
+	path string
+}
+
+// parseRemoteArg parses `arg` as a remote argument, it reports false for a local path.
+// A colon after a path separator, or after a drive letter on Windows, is part of a local
+// path. The user is accepted as scp does and ignored, servers authenticate clients by
+// their certificate or token.
+func parseRemoteArg(arg string) (remoteArg, bool) {
+	s := arg
+	if at := strings.IndexByte(s, '@'); at > 0 && !strings.ContainsAny(s[:at], `:/\`) {
+		s = s[at+1:]
+	}
+	var host, rest string
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]:")
+		if end < 0 {
+			return remoteArg{}, false
+		}
+		host, rest = s[1:end], s[end+2:]
+	} else {
+		i := strings.IndexByte(s, ':')
+		if i < 0 || strings.ContainsAny(s[:i], `/\`) || (i == 1 && runtime.GOOS == "windows") {
+			return remoteArg{}, false
+		}
+		host, rest = s[:i], s[i+1:]
+	}
+	if host != "" {
+		// host:port:path, a path of digits only without a second colon is no port
+		if i := strings.IndexByte(rest, ':'); i > 0 {
+			if _, err := strconv.ParseUint(rest[:i], 10, 16); err == nil {
+				host, rest = net.JoinHostPort(host, rest[:i]), rest[i+1:]
+			}
+		}
+	} else if s != arg {
+		return remoteArg{}, false
+	}
+	return remoteArg{addr: host, path: rest}, true
+}
+
+// remoteArgOf returns `arg` as a remote argument, a path on the server of --addr unless
+// it addresses another one.
+func remoteArgOf(arg string) remoteArg {
+	if remote, ok := parseRemoteArg(arg); ok {
+		return remote
+	}
+	return remoteArg{path: arg}
+}
+
+// sameServer returns the server both `a` and `b` are on, they may not address two servers.
+func sameServer(a remoteArg, b remoteArg) (string, error) {
+	switch {
+	case a.addr == "":
+		return b.addr, nil
+	case b.addr == "" || parseAddr(a.addr) == parseAddr(b.addr):
+		return a.addr, nil
+	}
+	return "", errors.New("copying between two servers is not supported, copy through a local directory")
+}
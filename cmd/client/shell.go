@@ -0,0 +1,699 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"got/internal"
+	"got/pkg"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// shellCommand is a command of the interactive shell.
+type shellCommand struct {
+	usage string
+	help  string
+	// remote tells whether the arguments are remote paths, to complete them
+	remote bool
+	run    func(s *shell, args []string) error
+}
+
+var shellCommands map[string]*shellCommand
+
+func init() {
+	shellCommands = map[string]*shellCommand{
+		"ls":    {usage: "ls [-lharR] [--sort by] [--json] [dir]", help: "list a remote directory", remote: true, run: (*shell).list},
+		"cd":    {usage: "cd <dir>", help: "change the remote directory", remote: true, run: (*shell).change},
+		"pwd":   {usage: "pwd", help: "print the remote directory", run: (*shell).pwd},
+		"lls":   {usage: "lls [-lharR] [--sort by] [--json] [dir]", help: "list a local directory", run: (*shell).localList},
+		"lcd":   {usage: "lcd [dir]", help: "change the local directory, the home directory by default", run: (*shell).localChange},
+		"lpwd":  {usage: "lpwd", help: "print the local directory", run: (*shell).localPwd},
+		"get":   {usage: "get [options] <path or pattern>...", help: "download remote files or directories", remote: true, run: (*shell).get},
+		"put":   {usage: "put [options] <path or pattern>...", help: "upload local files or directories", run: (*shell).put},
+		"cat":   {usage: "cat <path>...", help: "print remote files", remote: true, run: (*shell).cat},
+		"rm":    {usage: "rm [-r] <path>...", help: "remove remote files, directories with -r", remote: true, run: (*shell).remove},
+		"mkdir": {usage: "mkdir [-p] <dir>...", help: "create remote directories, with their parents with -p", remote: true, run: (*shell).makeDir},
+		"mv":    {usage: "mv [options] <source> <destination>", help: "move or rename a remote file or directory", remote: true, run: (*shell).move},
+		"cp":    {usage: "cp [-r] [options] <source> <destination>", help: "copy a remote file or directory on the server", remote: true, run: (*shell).copy},
+		"tree":  {usage: "tree [-a] [-L level] [dir]", help: "list a remote directory as a tree", remote: true, run: (*shell).tree},
+		"stat":  {usage: "stat [-L] [--checksum] [--json] <path>...", help: "print the status of remote paths", remote: true, run: (*shell).stat},
+		"du":    {usage: "du [-s] [-h] [-d depth] [dir]...", help: "print the size of remote directories", remote: true, run: (*shell).diskUsage},
+		"df":    {usage: "df [-h] [path]", help: "print the space of the filesystem of the server", remote: true, run: (*shell).diskFree},
+		"help":  {usage: "help [command]", help: "print the help of the commands", run: (*shell).help},
+		"exit":  {usage: "exit", help: "leave the shell, as quit and Ctrl-D"},
+		"quit":  {usage: "quit", help: "leave the shell"},
+	}
+}
+
+// shell runs the commands read from the terminal or standard input over one connection
+// and session of the server.
+type shell struct {
+	ctx    *cli.Context
+	client internal.GotClient
+	reader *pkg.LineReader
+}
+
+func runShell(ctx *cli.Context) error {
+	gotClient, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+	s := &shell{ctx: ctx, client: gotClient, reader: pkg.NewLineReader(os.Stdin, os.Stdout)}
+	s.reader.Complete = s.complete
+
+	var historyFile string
+	if s.reader.Terminal() {
+		dir, err := internal.ConfigDir()
+		if err != nil {
+			return err
+		}
+		historyFile = filepath.Join(dir, "shell_history")
+		if err = s.reader.LoadHistory(historyFile); err != nil {
+			return err
+		}
+	}
+
+	for {
+		line, err := s.reader.ReadLine(s.prompt())
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		args, err := splitArgs(line)
+		if err == nil && len(args) == 0 {
+			continue
+		}
+		s.reader.AddHistory(strings.TrimSpace(line))
+		if err == nil {
+			if args[0] == "exit" || args[0] == "quit" {
+				break
+			}
+			err = s.run(args)
+		}
+		if err != nil {
+			// commands read from a file or pipe stop at the first failure as a script
+			if !s.reader.Terminal() {
+				return err
+			}
+			fmt.Println(err)
+		}
+	}
+
+	if historyFile != "" {
+		return s.reader.SaveHistory(historyFile)
+	}
+	return nil
+}
+
+func (s *shell) prompt() string {
+	cwd, err := s.client.WorkingDir()
+	if err != nil {
+		return "got> "
+	}
+	return fmt.Sprintf("got:%s> ", cwd)
+}
+
+func (s *shell) run(args []string) error {
+	command, ok := shellCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, type help for the commands", args[0])
+	}
+	return command.run(s, args[1:])
+}
+
+// splitArgs splits `line` into words separated by spaces, quotes and backslashes escape
+// spaces as in shells.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	var inWord, escaped bool
+	var quote rune
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// complete returns the command names completing the first word, or the remote or local
+// paths completing the arguments of a command.
+func (s *shell) complete(line string, word string) []string {
+	fields := strings.Fields(line)
+	var completions []string
+	if len(fields) == 0 || (len(fields) == 1 && !strings.HasSuffix(line, " ")) {
+		for name := range shellCommands {
+			if strings.HasPrefix(name, word) {
+				completions = append(completions, name)
+			}
+		}
+		sort.Strings(completions)
+		return completions
+	}
+	command, ok := shellCommands[fields[0]]
+	if !ok || strings.HasPrefix(word, "-") {
+		return nil
+	}
+
+	dir, base := path.Split(word)
+	var entries []*internal.FileEntry
+	var err error
+	if command.remote {
+		_, entries, err = s.client.ListFiles(dir)
+	} else if dir == "" {
+		_, entries, err = localListing(".")
+	} else {
+		_, entries, err = localListing(dir)
+	}
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		// dotfiles are completed once the dot is typed
+		if !strings.HasPrefix(entry.Name, base) || (strings.HasPrefix(entry.Name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		completion := dir + entry.Name
+		if entry.IsDir() {
+			completion += "/"
+		}
+		completions = append(completions, completion)
+	}
+	sort.Strings(completions)
+	return completions
+}
+
+// listArgs parses the options and directory of ls and lls as those of got list, short
+// options may be combined as in -lh.
+func listArgs(name string, args []string) (listOptions, string, error) {
+	options := listOptions{sort: "name"}
+	usage := errors.New("usage: " + shellCommands[name].usage)
+	var dirs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			dirs = append(dirs, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "--"):
+			flagName, value := arg[2:], ""
+			eq := strings.IndexByte(flagName, '=')
+			hasValue := eq >= 0
+			if hasValue {
+				flagName, value = flagName[:eq], flagName[eq+1:]
+			}
+			switch flagName {
+			case "long":
+				options.long = true
+			case "human-readable":
+				options.human = true
+			case "all":
+				options.all = true
+			case "reverse":
+				options.reverse = true
+			case "json":
+				options.json = true
+			case "recursive":
+				options.recursive = true
+			case "sort":
+				if !hasValue {
+					if i++; i == len(args) {
+						return options, "", usage
+					}
+					value = args[i]
+				}
+				options.sort = value
+			default:
+				return options, "", fmt.Errorf("unknown option %s", arg)
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			for _, c := range arg[1:] {
+				switch c {
+				case 'l':
+					options.long = true
+				case 'h':
+					options.human = true
+				case 'a':
+					options.all = true
+				case 'r':
+					options.reverse = true
+				case 'R':
+					options.recursive = true
+				default:
+					return options, "", fmt.Errorf("unknown option -%c", c)
+				}
+			}
+		default:
+			dirs = append(dirs, arg)
+		}
+	}
+	if len(dirs) > 1 {
+		return options, "", usage
+	}
+	var dir string
+	if len(dirs) == 1 {
+		dir = dirs[0]
+	}
+	return options, dir, checkSort(options.sort)
+}
+
+func (s *shell) list(args []string) error {
+	options, dir, err := listArgs("ls", args)
+	if err != nil {
+		return err
+	}
+	if options.recursive {
+		walker, err := s.client.Walk(dir, 0, options.all)
+		if err != nil {
+			return err
+		}
+		return printWalk(os.Stdout, walker, options)
+	}
+	dir, entries, err := s.client.ListFiles(dir)
+	if err != nil {
+		return err
+	}
+	return printListing(os.Stdout, dir, entries, options)
+}
+
+func (s *shell) change(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: " + shellCommands["cd"].usage)
+	}
+	_, _, err := s.client.ChangeDir(args[0])
+	return err
+}
+
+func (s *shell) pwd(args []string) error {
+	cwd, err := s.client.WorkingDir()
+	if err != nil {
+		return err
+	}
+	fmt.Println(cwd)
+	return nil
+}
+
+func (s *shell) localList(args []string) error {
+	options, dir, err := listArgs("lls", args)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = "."
+	}
+	if options.recursive {
+		if dir, err = filepath.Abs(dir); err != nil {
+			return err
+		}
+		return printWalk(os.Stdout, internal.WalkDir(dir, 0, options.all), options)
+	}
+	dir, entries, err := localListing(dir)
+	if err != nil {
+		return err
+	}
+	return printListing(os.Stdout, dir, entries, options)
+}
+
+func (s *shell) localChange(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: " + shellCommands["lcd"].usage)
+	}
+	var dir string
+	if len(args) == 1 {
+		dir = args[0]
+	} else {
+		var err error
+		if dir, err = os.UserHomeDir(); err != nil {
+			return err
+		}
+	}
+	return os.Chdir(dir)
+}
+
+func (s *shell) localPwd(args []string) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println(dir)
+	return nil
+}
+
+// addConflictFlags adds the conflict flags of the commands to `flags`, it returns them by name.
+func addConflictFlags(flags *flag.FlagSet) map[string]*bool {
+	conflicts := make(map[string]*bool, len(conflictFlags))
+	for _, f := range conflictFlags {
+		name := f.Names()[0]
+		conflicts[name] = flags.Bool(name, false, f.(*cli.BoolFlag).Usage)
+	}
+	return conflicts
+}
+
+// shellConflict returns the policy selected by `conflicts`, at most one may be set.
+func shellConflict(conflicts map[string]*bool) (internal.ConflictPolicy, error) {
+	var policy internal.ConflictPolicy
+	for _, f := range conflictFlags {
+		name := f.Names()[0]
+		if !*conflicts[name] {
+			continue
+		}
+		if policy != "" {
+			return "", fmt.Errorf("--%s and --%s are exclusive", policy, name)
+		}
+		policy = internal.ConflictPolicy(name)
+	}
+	return internal.ParseConflictPolicy(string(policy))
+}
+
+// transferFlagSet returns the flags of get and put as those of download and upload.
+func transferFlagSet(name string, options *internal.TransferOptions) (*flag.FlagSet, map[string]*bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	flags.BoolVar(&options.Resume, "resume", false, "resume an interrupted transfer of the same file")
+	flags.IntVar(&options.Parallel, "parallel", 1, "transfer a large file over N concurrent streams")
+	flags.BoolVar(&options.Tar, "tar", false, "transfer a directory as a single tar stream instead of file by file")
+	flags.IntVar(&options.Workers, "workers", internal.DefaultWorkers, "transfer the files of a directory over N concurrent streams")
+	flags.BoolVar(&options.ContinueOnError, "continue-on-error", false, "keep transferring the files of a directory after one failed")
+	flags.BoolVar(&options.Delta, "delta", false, "transfer only the changed blocks of files whose destination exists")
+	return flags, addConflictFlags(flags)
+}
+
+// transferArgs parses the options and paths of get and put.
+func transferArgs(name string, args []string) (internal.TransferOptions, []string, error) {
+	var options internal.TransferOptions
+	flags, conflicts := transferFlagSet(name, &options)
+	if err := flags.Parse(args); err != nil {
+		return options, nil, err
+	}
+	if flags.NArg() == 0 {
+		return options, nil, errors.New("usage: " + shellCommands[name].usage)
+	}
+	var err error
+	if options.Conflict, err = shellConflict(conflicts); err != nil {
+		return options, nil, err
+	}
+	switch {
+	case options.Parallel < 1:
+		err = errors.New("--parallel must be at least 1")
+	case options.Workers < 1:
+		err = errors.New("--workers must be at least 1")
+	case options.Resume && options.Parallel > 1:
+		err = errors.New("--resume and --parallel are exclusive")
+	case options.Delta && (options.Resume || options.Parallel > 1):
+		err = errors.New("--delta is exclusive with --resume and --parallel")
+	}
+	return options, flags.Args(), err
+}
+
+func (s *shell) get(args []string) error {
+	options, paths, err := transferArgs("get", args)
+	if err != nil {
+		return err
+	}
+	for i, p := range paths {
+		paths[i] = remotePath(p)
+	}
+	if len(paths) == 1 && !internal.IsPattern(paths[0]) {
+		result, err := s.client.DownloadFile(paths[0], "", options)
+		// the progress bar leaves the cursor on its line
+		fmt.Println()
+		printResult(s.ctx, paths[0], result)
+		return err
+	}
+	// patterns are matched by the server
+	items, err := s.client.DownloadFiles(paths, "", options)
+	printBatch(s.ctx, items)
+	return err
+}
+
+func (s *shell) put(args []string) error {
+	options, paths, err := transferArgs("put", args)
+	if err != nil {
+		return err
+	}
+	// patterns are matched here as a shell would
+	var filePaths []string
+	for _, p := range paths {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return err
+		} else if len(matches) == 0 {
+			matches = []string{p}
+		}
+		for _, match := range matches {
+			filePaths = append(filePaths, filepath.Clean(match))
+		}
+	}
+	paths = filePaths
+	if len(paths) == 1 {
+		result, err := s.client.UploadFile(paths[0], "", options)
+		// the progress bar leaves the cursor on its line
+		fmt.Println()
+		printResult(s.ctx, paths[0], result)
+		return err
+	}
+	items, err := s.client.UploadFiles(paths, "", options)
+	printBatch(s.ctx, items)
+	return err
+}
+
+func (s *shell) cat(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["cat"].usage)
+	}
+	for _, name := range args {
+		if _, err := s.client.ReadRange(name, 0, 0, os.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shell) remove(args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	recursive := flags.Bool("r", false, "remove directories with their content")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: " + shellCommands["rm"].usage)
+	}
+	for _, name := range flags.Args() {
+		if err := s.client.Remove(name, *recursive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shell) makeDir(args []string) error {
+	flags := flag.NewFlagSet("mkdir", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	parents := flags.Bool("p", false, "create the missing parents, an existing directory is no error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: " + shellCommands["mkdir"].usage)
+	}
+	for _, name := range flags.Args() {
+		if err := s.client.MakeDir(name, *parents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shell) move(args []string) error {
+	flags := flag.NewFlagSet("mv", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	conflicts := addConflictFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: " + shellCommands["mv"].usage)
+	}
+	conflict, err := shellConflict(conflicts)
+	if err != nil {
+		return err
+	}
+	result, err := s.client.Rename(flags.Arg(0), flags.Arg(1), conflict)
+	if err != nil {
+		return err
+	}
+	printResult(s.ctx, flags.Arg(1), result)
+	return nil
+}
+
+func (s *shell) copy(args []string) error {
+	flags := flag.NewFlagSet("cp", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	recursive := flags.Bool("r", false, "copy directories with their content")
+	conflicts := addConflictFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: " + shellCommands["cp"].usage)
+	}
+	conflict, err := shellConflict(conflicts)
+	if err != nil {
+		return err
+	}
+	result, err := s.client.Copy(flags.Arg(0), flags.Arg(1), *recursive, conflict)
+	if err != nil {
+		return err
+	}
+	printResult(s.ctx, flags.Arg(1), result)
+	return nil
+}
+
+func (s *shell) tree(args []string) error {
+	flags := flag.NewFlagSet("tree", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	all := flags.Bool("a", false, "list the entries starting with '.'")
+	level := flags.Int("L", 0, "descend at most N levels, all if 0")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 || *level < 0 {
+		return errors.New("usage: " + shellCommands["tree"].usage)
+	}
+	walker, err := s.client.Walk(flags.Arg(0), *level, *all)
+	if err != nil {
+		return err
+	}
+	return printTree(os.Stdout, walker, *level)
+}
+
+func (s *shell) stat(args []string) error {
+	flags := flag.NewFlagSet("stat", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	var options internal.StatOptions
+	flags.BoolVar(&options.Follow, "L", false, "print the target of a symlink instead of the symlink")
+	flags.BoolVar(&options.Checksum, "checksum", false, "print the checksum of files")
+	asJSON := flags.Bool("json", false, "print the status as a JSON array")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: " + shellCommands["stat"].usage)
+	}
+	stats, err := statPaths(s.client, flags.Args(), options)
+	if len(stats) > 0 {
+		if printErr := printStats(os.Stdout, stats, *asJSON); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+func (s *shell) diskUsage(args []string) error {
+	flags := flag.NewFlagSet("du", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	maxDepth := flags.Int("d", -1, "print the directories at most N levels below the arguments, all if negative")
+	summarize := flags.Bool("s", false, "print only the total of each argument, as -d 0")
+	human := flags.Bool("h", false, "print sizes like 1.5M")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *summarize {
+		*maxDepth = 0
+	}
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		walker, err := s.client.Walk(dir, 0, true)
+		if err != nil {
+			return err
+		}
+		if err = printDiskUsage(os.Stdout, walker, dir, *maxDepth, *human); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shell) diskFree(args []string) error {
+	flags := flag.NewFlagSet("df", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	human := flags.Bool("h", false, "print sizes like 1.5G")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("usage: " + shellCommands["df"].usage)
+	}
+	space, err := s.client.DiskSpace(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	printDiskSpace(os.Stdout, space, *human)
+	return nil
+}
+
+func (s *shell) help(args []string) error {
+	if len(args) == 1 {
+		command, ok := shellCommands[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		fmt.Printf("%s\n    %s\n", command.usage, command.help)
+		if args[0] == "get" || args[0] == "put" {
+			flags, _ := transferFlagSet(args[0], &internal.TransferOptions{})
+			flags.PrintDefaults()
+		}
+		return nil
+	}
+	names := make([]string, 0, len(shellCommands))
+	var width int
+	for name, command := range shellCommands {
+		names = append(names, name)
+		if len(command.usage) > width {
+			width = len(command.usage)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%-*s  %s\n", width, shellCommands[name].usage, shellCommands[name].help)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"got/internal"
+	"got/pkg"
+	"io"
+	"os"
+	"path"
+	"strconv"
+)
+
+// nextListing returns the next directory of `walker`, one of the directories it descends
+// into, so that the walk may not end before.
+func nextListing(walker internal.DirWalker) (*internal.DirListing, error) {
+	listing, err := walker.Next()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return listing, err
+}
+
+// treePrinter prints the directories of a walk as a tree.
+type treePrinter struct {
+	w        io.Writer
+	walker   internal.DirWalker
+	maxDepth int
+	dirs     int
+	files    int
+}
+
+// printTree prints the directories of `walker`, a walk of `maxDepth` levels, to `w` as a tree
+// followed by the count of its directories and files.
+func printTree(w io.Writer, walker internal.DirWalker, maxDepth int) error {
+	defer walker.Close()
+	listing, err := walker.Next()
+	if err != nil {
+		return err
+	}
+	t := &treePrinter{w: w, walker: walker, maxDepth: maxDepth}
+	fmt.Fprintln(w, listing.Dir)
+	if err = t.printDir(listing, "", 1); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d directories, %d files\n", t.dirs, t.files)
+	return nil
+}
+
+// printDir prints the entries of `listing` of level `depth` below `prefix`, each directory is
+// followed by its own as the walk lists them.
+func (t *treePrinter) printDir(listing *internal.DirListing, prefix string, depth int) error {
+	for i, entry := range listing.Entries {
+		branch, indent := "├── ", "│   "
+		if i == len(listing.Entries)-1 {
+			branch, indent = "└── ", "    "
+		}
+		if entry.IsDir() {
+			t.dirs++
+		} else {
+			t.files++
+		}
+		fmt.Fprint(t.w, prefix+branch+displayName(entry, true))
+		if !internal.Descends(entry, depth, t.maxDepth) {
+			fmt.Fprintln(t.w)
+			continue
+		}
+		sub, err := nextListing(t.walker)
+		if err != nil {
+			fmt.Fprintln(t.w)
+			return err
+		}
+		// a directory which cannot be read is marked as by tree
+		if sub.Err != nil {
+			fmt.Fprintf(t.w, "  [%v]\n", sub.Err)
+			continue
+		}
+		fmt.Fprintln(t.w)
+		if err = t.printDir(sub, prefix+indent, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usagePrinter prints the sizes of the directories of a walk as du.
+type usagePrinter struct {
+	w      io.Writer
+	walker internal.DirWalker
+	// maxDepth is the depth of the directories printed below the walked one, all if negative
+	maxDepth int
+	human    bool
+}
+
+// printDiskUsage prints the total size of the files under each directory of `walker`, a walk
+// of all levels, to `w` down to `maxDepth` levels below the walked directory `name`, all if
+// negative. Subdirectories are printed before their directory as by du.
+func printDiskUsage(w io.Writer, walker internal.DirWalker, name string, maxDepth int, human bool) error {
+	defer walker.Close()
+	listing, err := walker.Next()
+	if err != nil {
+		return err
+	}
+	u := &usagePrinter{w: w, walker: walker, maxDepth: maxDepth, human: human}
+	_, err = u.printDir(listing, name, 0)
+	return err
+}
+
+// printDir prints the sizes of the directories of `listing` named `name` at level `depth`
+// and its own, it returns the latter.
+func (u *usagePrinter) printDir(listing *internal.DirListing, name string, depth int) (int64, error) {
+	var total int64
+	for _, entry := range listing.Entries {
+		switch {
+		case entry.IsDir():
+			sub, err := nextListing(u.walker)
+			if err != nil {
+				return 0, err
+			}
+			subName := path.Join(name, entry.Name)
+			if sub.Err != nil {
+				fmt.Fprintf(os.Stderr, "cannot read %s: %v\n", subName, sub.Err)
+				continue
+			}
+			size, err := u.printDir(sub, subName, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			total += size
+		case entry.FileMode().IsRegular():
+			total += entry.Size
+		}
+	}
+	if u.maxDepth < 0 || depth <= u.maxDepth {
+		fmt.Fprintf(u.w, "%s\t%s\n", u.size(total), name)
+	}
+	return total, nil
+}
+
+func (u *usagePrinter) size(size int64) string {
+	if u.human {
+		return pkg.HumanSize(size)
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+// printDiskSpace prints the size, used and available space of filesystem `space` to `w` as df.
+func printDiskSpace(w io.Writer, space internal.DiskSpace, human bool) {
+	format := func(size int64) string {
+		if human {
+			return pkg.HumanSize(size)
+		}
+		return strconv.FormatInt(size, 10)
+	}
+	used := space.Total - space.Free
+	// the use is of the space available to the server as in df, rounded up
+	usePercent := "-"
+	if used+space.Available > 0 {
+		usePercent = fmt.Sprintf("%d%%", (used*100+used+space.Available-1)/(used+space.Available))
+	}
+	columns := [][]string{
+		{"size", "used", "avail", "use%", "path"},
+		{format(space.Total), format(used), format(space.Available), usePercent, space.Path},
+	}
+	widths := make([]int, len(columns[0]))
+	for _, row := range columns {
+		for i, value := range row {
+			if len(value) > widths[i] {
+				widths[i] = len(value)
+			}
+		}
+	}
+	for _, row := range columns {
+		fmt.Fprintf(w, "%*s  %*s  %*s  %*s  %s\n", widths[0], row[0], widths[1], row[1], widths[2], row[2],
+			widths[3], row[3], row[4])
+	}
+}
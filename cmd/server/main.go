@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"got/internal"
+	"got/pkg"
 	"os"
+	"strings"
 )
 
 var version string
@@ -20,16 +22,140 @@ func main() {
 			Value:   9876,
 			Usage:   "server port",
 		},
+		&cli.StringFlag{
+			Name:  "root",
+			Usage: "directory all file access is confined to (default: the working directory)",
+		},
+		&cli.StringFlag{
+			Name:  "staging-dir",
+			Usage: "directory keeping uploads until they are complete out of the root (default: got/staging in the user config directory)",
+		},
+		&cli.Int64Flag{
+			Name:  "max-untar-bytes",
+			Value: pkg.DefaultUnTarLimits.MaxBytes,
+			Usage: "max total size of an uploaded directory, 0 means no limit",
+		},
+		&cli.IntFlag{
+			Name:  "max-untar-entries",
+			Value: pkg.DefaultUnTarLimits.MaxEntries,
+			Usage: "max entry count of an uploaded directory, 0 means no limit",
+		},
+		&cli.IntFlag{
+			Name:  "max-untar-depth",
+			Value: pkg.DefaultUnTarLimits.MaxDepth,
+			Usage: "max path depth of an uploaded directory, 0 means no limit",
+		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "TLS certificate file, a self-signed certificate is generated if not specified",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "TLS private key file",
+		},
+		&cli.StringFlag{
+			Name:  "client-ca",
+			Usage: "CA certificate for verifying client certificates, enables mutual TLS",
+		},
+		&cli.StringFlag{
+			Name:  "tokens",
+			Usage: "file of accepted bearer tokens, one `<name> <sha256>` per line, enables token authentication",
+		},
+		&cli.StringFlag{
+			Name:  "chunk-size",
+			Value: pkg.FormatSize(internal.DefaultChunkSize),
+			Usage: "data size of download messages like 64K or 1M, auto grows it while the throughput improves",
+		},
+		&cli.StringFlag{
+			Name:  "max-message-size",
+			Value: pkg.FormatSize(internal.DefaultMaxMessageSize),
+			Usage: "max size of gRPC messages, chunks are bounded by the smaller max of both sides",
+		},
+		&cli.StringFlag{
+			Name:  "compress",
+			Value: strings.Join(pkg.CompressionAlgorithms(), ","),
+			Usage: "comma separated compression algorithms accepted from clients, empty disables compression",
+		},
+		&cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "disable TLS and accept plaintext connections",
+			Value: false,
+		},
 	}
 	app.Action = func(ctx *cli.Context) error {
-		var port = ctx.Int("port")
-		srv, err := internal.CreateServer(port)
+		chunkSize, adaptive, err := internal.ParseChunkSize(ctx.String("chunk-size"))
+		if err != nil {
+			return err
+		}
+		maxMessageSize, err := pkg.ParseSize(ctx.String("max-message-size"))
+		if err != nil {
+			return err
+		}
+		var config = internal.ServerConfig{
+			Port:       ctx.Int("port"),
+			Root:       ctx.String("root"),
+			StagingDir: ctx.String("staging-dir"),
+			UnTarLimits: pkg.UnTarLimits{
+				MaxBytes:   ctx.Int64("max-untar-bytes"),
+				MaxEntries: ctx.Int("max-untar-entries"),
+				MaxDepth:   ctx.Int("max-untar-depth"),
+			},
+			CertFile:          ctx.String("cert"),
+			KeyFile:           ctx.String("key"),
+			ClientCAFile:      ctx.String("client-ca"),
+			TokensFile:        ctx.String("tokens"),
+			ChunkSize:         chunkSize,
+			AdaptiveChunkSize: adaptive,
+			MaxMessageSize:    int(maxMessageSize),
+			Insecure:          ctx.Bool("insecure"),
+		}
+		for _, algorithm := range strings.Split(ctx.String("compress"), ",") {
+			if algorithm = strings.TrimSpace(algorithm); algorithm != "" {
+				config.Compression = append(config.Compression, algorithm)
+			}
+		}
+		if !config.Insecure && config.CertFile == "" && config.KeyFile == "" {
+			dir, err := internal.ConfigDir()
+			if err != nil {
+				return err
+			}
+			config.CertFile, config.KeyFile, err = internal.SelfSignedCert(dir)
+			if err != nil {
+				return err
+			}
+		}
+		if !config.Insecure {
+			fingerprint, err := pkg.CertFileFingerprint(config.CertFile)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Got server certificate: %s\n", config.CertFile)
+			fmt.Printf("Got server fingerprint: %s\n", fingerprint)
+		}
+
+		srv, err := internal.CreateServer(config)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Got server started at %d\n", port)
+		fmt.Printf("Got server started at %d\n", config.Port)
 		return srv.Run()
 	}
+	app.Commands = []*cli.Command{
+		{
+			Name:      "token",
+			Usage:     "generate a bearer token, append the printed line to the tokens file",
+			ArgsUsage: "<name>",
+			Action: func(ctx *cli.Context) error {
+				token, line, err := internal.GenerateToken(ctx.Args().First())
+				if err != nil {
+					return err
+				}
+				fmt.Printf("token: %s\n", token)
+				fmt.Printf("line:  %s\n", line)
+				return nil
+			},
+		},
+	}
 	err := app.Run(os.Args)
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"got/pkg"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var errExtractAborted = errors.New("extraction aborted")
+
+// dirExtractor unpacks the tar stream of a directory while it is being received.
+// The stream is extracted into a temporary directory next to the target, which is
+// moved in place by commit once the stream is complete and verified.
+type dirExtractor struct {
+	target string
+	tmpDir string
+	pw     *io.PipeWriter
+	done   chan error
+
+	once sync.Once
+	err  error
+}
+
+func newDirExtractor(target string, limits pkg.UnTarLimits) (*dirExtractor, error) {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(target), ".got-*")
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	e := &dirExtractor{target: target, tmpDir: tmpDir, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := pkg.UnTarFrom(pr, tmpDir, limits)
+		if err == nil {
+			// whatever follows the end of the archive is not extracted
+			_, err = io.Copy(io.Discard, pr)
+		}
+		_ = pr.CloseWithError(err)
+		e.done <- err
+	}()
+	return e, nil
+}
+
+// Write passes `p` to the extraction, it fails with the error of the extraction.
+func (e *dirExtractor) Write(p []byte) (int, error) {
+	return e.pw.Write(p)
+}
+
+// finish ends the stream and waits for the extraction.
+func (e *dirExtractor) finish(err error) error {
+	e.once.Do(func() {
+		_ = e.pw.CloseWithError(err)
+		e.err = <-e.done
+	})
+	return e.err
+}
+
+// abort stops the extraction and removes what was extracted, it does nothing after commit.
+func (e *dirExtractor) abort() {
+	_ = e.finish(errExtractAborted)
+	_ = os.RemoveAll(e.tmpDir)
+}
+
+// commit waits for the extraction and moves the extracted directory to the target,
+// an existing target directory is merged with it.
+func (e *dirExtractor) commit() error {
+	defer os.RemoveAll(e.tmpDir)
+	if err := e.finish(nil); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(e.tmpDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 {
+		return fmt.Errorf("directory archive has %d top-level entries", len(entries))
+	}
+	src := filepath.Join(e.tmpDir, entries[0].Name())
+	if _, err = os.Lstat(e.target); os.IsNotExist(err) {
+		return os.Rename(src, e.target)
+	}
+	return pkg.MergeDir(src, e.target)
+}
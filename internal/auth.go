@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"os"
+	"strings"
+)
+
+const authorizationKey = "authorization"
+const bearerPrefix = "Bearer "
+
+// GenerateToken creates a random token and the line to append to the server's token file for it.
+func GenerateToken(name string) (string, string, error) {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return "", "", fmt.Errorf("invalid token name %q", name)
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(secret)
+	return token, fmt.Sprintf("%s %s", name, hashToken(token)), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenEntry is one line of the token file: the token name and the hex SHA-256 of its secret.
+type tokenEntry struct {
+	name string
+	hash []byte
+}
+
+func loadTokens(path string) ([]tokenEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tokens []tokenEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expect `<name> <sha256>`", path, line)
+		}
+		hash, err := hex.DecodeString(fields[1])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid sha256 hash", path, line)
+		}
+		tokens = append(tokens, tokenEntry{name: fields[0], hash: hash})
+	}
+	return tokens, scanner.Err()
+}
+
+// authenticator resolves the caller identity of every request, from the client
+// certificate or from the bearer token, and rejects unauthenticated calls.
+type authenticator struct {
+	tokens      []tokenEntry
+	requireAuth bool
+}
+
+func (a *authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	if identity := peerIdentity(ctx); identity != "" {
+		return WithIdentity(ctx, identity), nil
+	}
+	if !a.requireAuth {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationKey)
+	if len(values) == 0 || !strings.HasPrefix(values[0], bearerPrefix) {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(values[0], bearerPrefix)))
+	for _, entry := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], entry.hash) == 1 {
+			return WithIdentity(ctx, entry.name), nil
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// tokenCredentials attaches the bearer token to every RPC, over TLS only.
+type tokenCredentials struct {
+	token string
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorizationKey: bearerPrefix + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
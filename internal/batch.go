@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"got/pkg"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchItem is the outcome of a transfer of a batch.
+type BatchItem struct {
+	// Path is the source of the transfer, or a pattern which failed to match
+	Path   string
+	Result TransferResult
+	Err    error
+}
+
+// IsPattern reports whether remote path `p` is a glob pattern, matched by the server.
+func IsPattern(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// UploadFiles uploads local files or directories `filePaths` to remote path `dst` as
+// UploadFile with one progress bar, a failure does not stop the others. Several files are
+// uploaded into `dst`, which must be a directory then.
+func (d *defaultClient) UploadFiles(filePaths []string, dst string, options TransferOptions) ([]BatchItem, error) {
+	if len(filePaths) > 1 && dst != "" {
+		if err := d.remoteDir(dst); err != nil {
+			return nil, err
+		}
+	}
+	sizes := make([]int64, len(filePaths))
+	for i, filePath := range filePaths {
+		// a missing file fails its upload
+		sizes[i], _ = localSize(filePath, options.Tar)
+	}
+	return transferBatch("upload", filePaths, sizes, options, func(i int, options TransferOptions) (TransferResult, error) {
+		if len(filePaths) == 1 {
+			return d.UploadFile(filePaths[i], dst, options)
+		}
+		base, err := localBase(filePaths[i])
+		if err != nil {
+			return TransferResult{}, err
+		}
+		return d.uploadFile(filePaths[i], path.Join(dst, base), options)
+	})
+}
+
+// localSize returns the bytes the upload of local file or directory `filePath` transfers.
+func localSize(filePath string, tar bool) (int64, error) {
+	info, err := os.Stat(filePath)
+	switch {
+	case err != nil:
+		return 0, err
+	case !info.IsDir():
+		return info.Size(), nil
+	case tar:
+		return pkg.TarSize(filePath)
+	}
+	return contentSize(filePath)
+}
+
+// contentSize returns the total size of the regular files under directory `dir`.
+func contentSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// DownloadFiles downloads the remote files and directories matching `patterns` to local
+// path `dst` as DownloadFile with one progress bar, a failure does not stop the others.
+// A pattern matching nothing fails. Several files are downloaded into `dst`, which must
+// be a directory then.
+func (d *defaultClient) DownloadFiles(patterns []string, dst string, options TransferOptions) ([]BatchItem, error) {
+	var names []string
+	var sizes []int64
+	failed := make(map[int]error)
+	for _, pattern := range patterns {
+		matches, err := d.Glob(pattern)
+		if status.Code(err) == codes.Unimplemented && !IsPattern(pattern) {
+			// servers without globs download the path as it is, of a size unknown
+			matches, err = []*GlobMatch{{Name: pattern, Size: -1}}, nil
+		} else if err == nil && len(matches) == 0 {
+			err = status.Errorf(codes.NotFound, "no match for %s", pattern)
+		}
+		if err != nil {
+			failed[len(names)] = err
+			names, sizes = append(names, pattern), append(sizes, 0)
+		}
+		for _, match := range matches {
+			// the size of a directory is unknown before its download
+			size := match.Size
+			if match.Type == dirType {
+				size = -1
+			}
+			names, sizes = append(names, match.Name), append(sizes, size)
+		}
+	}
+	if len(names) > 1 && dst != "" {
+		if info, err := os.Stat(dst); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dst)
+		}
+	}
+	return transferBatch("download", names, sizes, options, func(i int, options TransferOptions) (TransferResult, error) {
+		if err, ok := failed[i]; ok {
+			return TransferResult{}, err
+		}
+		return d.DownloadFile(path.Clean(names[i]), dst, options)
+	})
+}
+
+// transferBatch transfers `paths` of `sizes` bytes by `transfer` of their index with one
+// progress bar, a failure does not stop the others. A negative size is unknown, the bar
+// then shows the bytes transferred.
+func transferBatch(tag string, paths []string, sizes []int64, options TransferOptions,
+	transfer func(i int, options TransferOptions) (TransferResult, error)) ([]BatchItem, error) {
+	var total int64
+	for _, size := range sizes {
+		if size < 0 {
+			total = -1
+			break
+		}
+		total += size
+	}
+	progress := &batchProgress{push: make(chan int64, 2)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	procBar, _ := pkg.ProcessBar(tag, 0, total, progress.push, ctx)
+	options.progress = progress
+
+	items := make([]BatchItem, len(paths))
+	var failed int
+	for i := range paths {
+		sent := atomic.LoadInt64(&progress.sent)
+		result, err := transfer(i, options)
+		items[i] = BatchItem{Path: paths[i], Result: result, Err: err}
+		if err != nil {
+			failed++
+		}
+		// the bytes not sent, of unchanged files or failures, count as done of a known total
+		progress.wg.Wait()
+		if rest := sizes[i] - (atomic.LoadInt64(&progress.sent) - sent); total >= 0 && rest > 0 {
+			progress.push <- rest
+		}
+	}
+	// a bar of an unknown total ends with its progress
+	close(progress.push)
+	<-procBar
+	if failed > 0 {
+		return items, fmt.Errorf("%d of %d %ss failed", failed, len(paths), tag)
+	}
+	return items, nil
+}
+
+// batchProgress is the progress bar of a batch of transfers, shown instead of their own.
+type batchProgress struct {
+	push chan int64
+	// sent counts the bytes the transfers forwarded
+	sent int64
+	wg   sync.WaitGroup
+}
+
+// processBar shows the progress bar of a transfer from `start` to `end` bytes pushed to
+// `push` as pkg.ProcessBar, or forwards its progress to the bar of its batch.
+func processBar(tag string, start int64, end int64, push <-chan int64, ctx context.Context,
+	options TransferOptions) <-chan struct{} {
+	if options.progress == nil {
+		procBar, _ := pkg.ProcessBar(tag, start, end, push, ctx)
+		return procBar
+	}
+	return options.progress.forward(end-start, push, ctx)
+}
+
+// forward forwards the progress of a transfer of `size` bytes from `push` until it is
+// closed. The returned channel is closed once `size` bytes are forwarded or `ctx` is done.
+func (p *batchProgress) forward(size int64, push <-chan int64, ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	var once sync.Once
+	finish := func() {
+		once.Do(func() { close(done) })
+	}
+	if size <= 0 {
+		finish()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer finish()
+		ctxDone := ctx.Done()
+		for {
+			select {
+			case n, ok := <-push:
+				if !ok {
+					return
+				}
+				atomic.AddInt64(&p.sent, n)
+				p.push <- n
+				if size -= n; size <= 0 {
+					finish()
+				}
+			case <-ctxDone:
+				// the progress is drained until the transfer ends
+				finish()
+				ctxDone = nil
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"fmt"
+	"got/pkg"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxMessageSizeKey = "max-message-size"
+
+const (
+	// DefaultChunkSize is the size of the data of a transfer message
+	DefaultChunkSize = 64 << 10
+	// DefaultMaxMessageSize is the max size of a gRPC message, as the gRPC default
+	DefaultMaxMessageSize = 4 << 20
+	// ChunkSizeAuto selects the adaptive chunk size
+	ChunkSizeAuto = "auto"
+
+	// minChunkSize is the chunk size an adaptive transfer starts with
+	minChunkSize = 16 << 10
+	// messageOverhead is reserved in a message for the fields besides data
+	messageOverhead = 1 << 10
+	// adaptWindow is the count of chunks the throughput of a chunk size is measured over
+	adaptWindow = 32
+)
+
+// ParseChunkSize parses the chunk size option, a size or ChunkSizeAuto. A size of 0
+// means DefaultChunkSize.
+func ParseChunkSize(s string) (int, bool, error) {
+	if s == ChunkSizeAuto {
+		return 0, true, nil
+	}
+	size, err := pkg.ParseSize(s)
+	if err != nil {
+		return 0, false, err
+	}
+	if size > 1<<30 {
+		return 0, false, fmt.Errorf("chunk size %s too large", s)
+	}
+	return int(size), false, nil
+}
+
+// chunkLimit returns the max chunk size fitting in messages of `maxMessageSize`.
+func chunkLimit(maxMessageSize int) int {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	if maxMessageSize <= 2*messageOverhead {
+		return maxMessageSize / 2
+	}
+	return maxMessageSize - messageOverhead
+}
+
+// peerChunkLimit bounds `limit` by the max message size the peer announced in `values`.
+func peerChunkLimit(limit int, values []string) int {
+	if values == nil {
+		return limit
+	}
+	if size, err := strconv.Atoi(values[0]); err == nil && size > 0 && chunkLimit(size) < limit {
+		return chunkLimit(size)
+	}
+	return limit
+}
+
+// chunkPools keeps the chunk buffers of finished transfers by size for reuse.
+var chunkPools sync.Map
+
+func getChunk(size int) []byte {
+	pool, _ := chunkPools.LoadOrStore(size, &sync.Pool{New: func() interface{} {
+		return make([]byte, size)
+	}})
+	return pool.(*sync.Pool).Get().([]byte)
+}
+
+func putChunk(chunk []byte) {
+	if pool, ok := chunkPools.Load(cap(chunk)); ok {
+		pool.(*sync.Pool).Put(chunk[:cap(chunk)])
+	}
+}
+
+// chunkSizer chooses the chunk size of a transfer. A fixed chunk size is kept, an adaptive
+// chunk size starts small and is doubled as long as the throughput improves.
+type chunkSizer struct {
+	size     int
+	limit    int
+	adaptive bool
+	buf      []byte
+
+	start time.Time
+	count int
+	bytes int64
+	rate  float64
+}
+
+// newChunkSizer returns the sizer of chunks of `size`, DefaultChunkSize if 0, or of an
+// adaptive size if `adaptive` is set. Chunks are at most `limit` bytes.
+func newChunkSizer(size int, adaptive bool, limit int) *chunkSizer {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if adaptive {
+		size = minChunkSize
+	}
+	if size > limit {
+		size = limit
+	}
+	c := &chunkSizer{size: size, limit: limit, adaptive: adaptive && size < limit}
+	if c.adaptive {
+		c.buf = getChunk(limit)
+	} else {
+		c.buf = getChunk(size)
+	}
+	return c
+}
+
+// chunk returns the buffer of the next chunk.
+func (c *chunkSizer) chunk() []byte {
+	return c.buf[:c.size]
+}
+
+// sent records `n` bytes sent, it adapts the chunk size after every window.
+func (c *chunkSizer) sent(n int) {
+	if !c.adaptive {
+		return
+	}
+	if c.count == 0 {
+		c.start = time.Now()
+	}
+	c.count++
+	c.bytes += int64(n)
+	if c.count < adaptWindow {
+		return
+	}
+	elapsed := time.Since(c.start).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1e-9
+	}
+	rate := float64(c.bytes) / elapsed
+	if rate > c.rate*1.1 {
+		c.rate = rate
+		if c.size *= 2; c.size >= c.limit {
+			c.size = c.limit
+			c.adaptive = false
+		}
+	} else {
+		// the throughput stopped improving, the previous size is kept
+		c.size /= 2
+		c.adaptive = false
+	}
+	c.count, c.bytes = 0, 0
+}
+
+// release returns the buffer for reuse by later transfers.
+func (c *chunkSizer) release() {
+	putChunk(c.buf)
+	c.buf = nil
+}
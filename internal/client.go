@@ -2,199 +2,730 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"got/pkg"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
 )
 
-func CreateClient(addr string) (GotClient, error) {
-	client := &defaultClient{addr: addr}
+func CreateClient(addr string, config ClientConfig) (GotClient, error) {
+	client := &defaultClient{addr: addr, config: config}
 	return client, client.Init()
 }
 
+type ClientConfig struct {
+	// CAFile is the CA certificate used for verifying the server
+	CAFile string
+	// CertFile and KeyFile are the client certificate for servers requiring mutual TLS
+	CertFile string
+	KeyFile  string
+	// KnownHostsFile stores pinned server fingerprints when no CAFile is given
+	KnownHostsFile string
+	// SessionsFile persists the server session and its current directory between invocations
+	SessionsFile string
+	// ChecksumAlgorithm verifies transfers end-to-end, pkg.DefaultChecksumAlgorithm if empty
+	ChecksumAlgorithm string
+	// Token is the bearer token attached to every request
+	Token string
+	// Compression is CompressionNone, CompressionAuto or an algorithm of pkg.CompressionAlgorithms
+	Compression string
+	// ChunkSize is the data size of upload messages, DefaultChunkSize if 0
+	ChunkSize int
+	// AdaptiveChunkSize grows the chunk size of uploads while the throughput improves
+	AdaptiveChunkSize bool
+	// MaxMessageSize bounds the size of gRPC messages, DefaultMaxMessageSize if 0
+	MaxMessageSize int
+	// Insecure disables TLS, data are transferred in plaintext
+	Insecure bool
+}
+
 type GotClient interface {
 	Init() error
-	ListFiles() (string, error)
-	ChangeDir(dstDir string) (string, error)
-	UploadFile(filePath string) error
-	DownloadFile(filePath string) error
+	ListFiles(dir string) (string, []*FileEntry, error)
+	ChangeDir(dstDir string) (string, []*FileEntry, error)
+	WorkingDir() (string, error)
+	UploadFile(filePath string, dst string, options TransferOptions) (TransferResult, error)
+	UploadReader(reader io.Reader, name string, options TransferOptions) (TransferResult, error)
+	DownloadFile(filePath string, dst string, options TransferOptions) (TransferResult, error)
+	ReadRange(filePath string, offset int64, length int64, w io.Writer) (int64, error)
+	Sync(localPath string, remotePath string, options SyncOptions) (SyncResult, error)
+	Remove(name string, recursive bool) error
+	MakeDir(name string, parents bool) error
+	Rename(from string, to string, conflict ConflictPolicy) (TransferResult, error)
+	Copy(from string, to string, recursive bool, conflict ConflictPolicy) (TransferResult, error)
+	Glob(pattern string) ([]*GlobMatch, error)
+	UploadFiles(filePaths []string, dst string, options TransferOptions) ([]BatchItem, error)
+	DownloadFiles(patterns []string, dst string, options TransferOptions) ([]BatchItem, error)
+	Walk(dir string, maxDepth int, all bool) (DirWalker, error)
+	DiskSpace(path string) (DiskSpace, error)
+	Stat(name string, options StatOptions) (FileStat, error)
+}
+
+// TransferOptions controls a single upload or download.
+type TransferOptions struct {
+	// Resume continues an interrupted transfer of the same file
+	Resume bool
+	// Conflict is enforced by the receiver when the destination exists
+	Conflict ConflictPolicy
+	// Parallel is the count of concurrent streams a large file is transferred over
+	Parallel int
+	// Tar transfers a directory as a single tar stream instead of file by file
+	Tar bool
+	// Workers is the count of concurrent streams the files of a directory are
+	// transferred over, DefaultWorkers if 0
+	Workers int
+	// ContinueOnError keeps transferring the files of a directory after one failed
+	ContinueOnError bool
+	// Delta transfers only the differences of a file to the existing destination
+	Delta bool
+
+	// progress is the bar of the batch of the transfer, shown instead of its own
+	progress *batchProgress
+}
+
+// TransferResult is the outcome of an upload, a download, or a move or copy on the server.
+type TransferResult struct {
+	// Path is where the data are saved, it differs from the requested path when renamed
+	Path     string
+	Checksum string
+	// Skipped reports the transfer is skipped for an existing destination
+	Skipped bool
+	// Files and Unchanged count the files of a directory transferred and already
+	// up to date, Failed lists the files which failed
+	Files     int
+	Unchanged int
+	Failed    []FileError
+}
+
+// FileError is the failure of a file of a directory transfer.
+type FileError struct {
+	// Path is relative to the directory, slash separated
+	Path string
+	Err  error
 }
 
 type defaultClient struct {
 	addr       string
+	config     ClientConfig
+	sessionMu  sync.Mutex
+	session    sessionState
 	grpcClient GotServiceClient
 }
 
 func (d *defaultClient) Init() error {
-	creds := insecure.NewCredentials()
-	options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	compression, err := ParseCompression(d.config.Compression)
+	if err != nil {
+		return err
+	}
+	d.config.Compression = compression
+	if d.config.MaxMessageSize <= 0 {
+		d.config.MaxMessageSize = DefaultMaxMessageSize
+	}
+
+	// a token sent in plaintext is as good as published
+	if d.config.Token != "" && d.config.Insecure {
+		return errors.New("token authentication requires TLS, a token is not sent with --insecure")
+	}
+	creds, err := clientCredentials(d.addr, d.config)
+	if err != nil {
+		return err
+	}
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(d.config.MaxMessageSize),
+			grpc.MaxCallSendMsgSize(d.config.MaxMessageSize)),
+	}
+	if d.config.Token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(
+			tokenCredentials{token: d.config.Token}))
+	}
 	conn, err := grpc.Dial(d.addr, options...)
 	if err != nil {
 		return err
 	}
 	d.grpcClient = NewGotServiceClient(conn)
+
+	if d.config.SessionsFile != "" {
+		d.session, err = loadSessionState(d.config.SessionsFile, d.addr)
+	}
 	return err
 }
 
-func (d *defaultClient) ListFiles() (string, error) {
-	resp, err := d.grpcClient.ListFile(context.Background(),
-		&ListFilesRequest{})
+// context returns the outgoing context of a request carrying `mdMap` and the session.
+func (d *defaultClient) context(mdMap map[string]string) context.Context {
+	return d.outgoingContext(context.Background(), mdMap)
+}
+
+// outgoingContext returns `ctx` carrying `mdMap` and the session.
+func (d *defaultClient) outgoingContext(ctx context.Context, mdMap map[string]string) context.Context {
+	md := metadata.New(mdMap)
+	if d.config.ChecksumAlgorithm != "" {
+		md.Set(checksumAlgorithmKey, d.config.ChecksumAlgorithm)
+	}
+	md.Set(maxMessageSizeKey, strconv.Itoa(d.config.MaxMessageSize))
+	d.sessionMu.Lock()
+	defer d.sessionMu.Unlock()
+	if d.session.Session != "" {
+		md.Set(sessionKey, d.session.Session)
+	}
+	if d.session.Cwd != "" {
+		md.Set(cwdKey, d.session.Cwd)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// acceptCompression returns the compression algorithms offered for transferring `name`.
+func (d *defaultClient) acceptCompression(name string, isDir bool) string {
+	switch d.config.Compression {
+	case CompressionNone:
+		return ""
+	case CompressionAuto:
+		if !isDir && pkg.IsCompressed(name) {
+			return ""
+		}
+		return strings.Join(pkg.CompressionAlgorithms(), ",")
+	}
+	return d.config.Compression
+}
+
+// updateSession remembers the session and current directory the server responded with,
+// it may be called by concurrent streams.
+func (d *defaultClient) updateSession(md metadata.MD) error {
+	d.sessionMu.Lock()
+	defer d.sessionMu.Unlock()
+	previous := d.session
+	if s := md.Get(sessionKey); s != nil {
+		d.session.Session = s[0]
+	}
+	if c := md.Get(cwdKey); c != nil {
+		d.session.Cwd = c[0]
+	}
+	if d.config.SessionsFile == "" || d.session == previous {
+		return nil
+	}
+	return saveSessionState(d.config.SessionsFile, d.addr, d.session)
+}
+
+// ListFiles returns remote directory `dir` resolved, the current one if empty, and its entries.
+func (d *defaultClient) ListFiles(dir string) (string, []*FileEntry, error) {
+	var header metadata.MD
+	resp, err := d.grpcClient.ListFile(d.context(nil),
+		&ListFilesRequest{Dir: dir}, grpc.Header(&header))
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Dir, resp.Entries, d.updateSession(header)
+}
+
+// ChangeDir changes the current remote directory to `dstDir`, it returns the new one and
+// its entries.
+func (d *defaultClient) ChangeDir(dstDir string) (string, []*FileEntry, error) {
+	var header metadata.MD
+	resp, err := d.grpcClient.ChangeDir(d.context(nil),
+		&ChangeDirRequest{DstDir: dstDir}, grpc.Header(&header))
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Dir, resp.Entries, d.updateSession(header)
+}
+
+// WorkingDir returns the current remote directory, it is asked for unless known from
+// previous requests.
+func (d *defaultClient) WorkingDir() (string, error) {
+	d.sessionMu.Lock()
+	cwd := d.session.Cwd
+	d.sessionMu.Unlock()
+	if cwd != "" {
+		return cwd, nil
+	}
+	if _, _, err := d.ListFiles(""); err != nil {
+		return "", err
+	}
+	d.sessionMu.Lock()
+	defer d.sessionMu.Unlock()
+	return d.session.Cwd, nil
+}
+
+// UploadFile uploads local file or directory `filePath` to remote path `dst`. An existing
+// remote directory or a `dst` ending with '/' receives it under its base name, the current
+// remote directory if `dst` is empty.
+func (d *defaultClient) UploadFile(filePath string, dst string, options TransferOptions) (TransferResult, error) {
+	name, err := d.remoteTarget(filePath, dst)
 	if err != nil {
-		return "", nil
+		return TransferResult{}, err
+	}
+	return d.uploadFile(filePath, name, options)
+}
+
+// remoteTarget returns the remote path local `filePath` is uploaded to for destination `dst`.
+func (d *defaultClient) remoteTarget(filePath string, dst string) (string, error) {
+	base, err := localBase(filePath)
+	if err != nil || dst == "" {
+		return base, err
+	}
+	// a destination ending with '/' must be a directory
+	err = d.remoteDir(dst)
+	switch {
+	case err == nil:
+		return path.Join(dst, base), nil
+	case strings.HasSuffix(dst, "/"):
+		return "", err
+	case status.Code(err) == codes.NotFound || status.Code(err) == codes.FailedPrecondition:
+		return dst, nil
 	}
-	return resp.Info, nil
+	return "", err
 }
 
-func (d *defaultClient) ChangeDir(dstDir string) (string, error) {
-	resp, err := d.grpcClient.ChangeDir(context.Background(),
-		&ChangeDirRequest{DstDir: dstDir})
+// localBase returns the name of local file `filePath`, that of the directory for '.'.
+func localBase(filePath string) (string, error) {
+	absPath, err := filepath.Abs(filePath)
 	if err != nil {
 		return "", err
 	}
-	return resp.Info, nil
+	return filepath.Base(absPath), nil
 }
 
-func (d *defaultClient) UploadFile(filePath string) error {
+// uploadFile uploads local file or directory `filePath` as remote path `name`.
+func (d *defaultClient) uploadFile(filePath string, name string, options TransferOptions) (TransferResult, error) {
 	// get file information
 	info, err := os.Stat(filePath)
 	if err != nil {
-		return err
+		return TransferResult{}, err
+	}
+
+	// an existing destination is skipped before anything is sent, the server skips it
+	// otherwise
+	if options.Conflict == ConflictSkip {
+		if stat, err := d.Stat(name, StatOptions{}); err == nil {
+			return TransferResult{Path: stat.Path, Skipped: true}, nil
+		}
+	}
+
+	if info.IsDir() && !options.Tar {
+		return d.uploadDir(filePath, name, options)
+	}
+	if options.Parallel > 1 && info.Mode().IsRegular() && len(partRanges(info.Size(), options.Parallel)) > 1 {
+		return d.uploadParallel(filePath, name, info, options)
+	}
+	if options.Delta && info.Mode().IsRegular() {
+		if result, err := d.uploadDelta(filePath, name, info, options); err != errNoBase {
+			return result, err
+		}
 	}
 
 	// metadata map
 	var mdMap = make(map[string]string)
+	mdMap["name"] = name
+	if options.Conflict != "" {
+		mdMap[conflictKey] = string(options.Conflict)
+	}
+	if accept := d.acceptCompression(filePath, info.IsDir()); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
 
-	// if the specified upload is a directory
-	if info.IsDir() {
-		// make new name for tar file
-		dirTarPath := filepath.Join(filepath.Dir(filePath),
-			fmt.Sprintf("%s%d.tar", filepath.Base(filePath), time.Now().Unix()))
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return TransferResult{}, err
+	}
 
-		// pack directory as temporary tar file for transfer
-		err := pkg.Tar(filePath, dirTarPath)
+	// a directory is sent as tar stream produced on the fly, its size is known in advance
+	var reader io.Reader
+	var size = info.Size()
+	if info.IsDir() {
+		mdMap["type"] = dirType
+		// the stream is written from the listing it is sized by
+		listing, err := pkg.ListTar(filePath)
 		if err != nil {
-			return err
+			return TransferResult{}, err
 		}
-
-		// set up information for new tar file
-		mdMap["type"] = dirType
-		filePath = dirTarPath
-		info, err = os.Stat(dirTarPath)
-
-		// remove temporary tar file.
-		defer func() {
-			err = os.Remove(filePath)
+		size = listing.Size
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			_, err := listing.WriteTo(pw)
+			_ = pw.CloseWithError(err)
 		}()
+		reader = pr
 	} else {
 		mdMap["type"] = fileType
+
+		// open file which will be transfer
+		file, err := os.OpenFile(filePath, os.O_RDONLY, 0664)
+		if err != nil {
+			return TransferResult{}, err
+		}
+		defer file.Close()
+		reader = file
+		// the size of a pipe or device is known once read
+		if !info.Mode().IsRegular() {
+			size = -1
+		}
 	}
-	mdMap["name"] = filePath
 
-	// open file which will be transfer
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0664)
+	// a resumable upload continues from the bytes the server has already staged
+	var offset int64
+	if options.Resume && size < 0 {
+		return TransferResult{}, fmt.Errorf("%s is not a regular file, its upload cannot be resumed", filePath)
+	}
+	if options.Resume {
+		transferID, err := d.transferID(filePath, name, info, size)
+		if err != nil {
+			return TransferResult{}, err
+		}
+		resp, err := d.grpcClient.UploadStatus(d.context(nil), &UploadStatusRequest{TransferId: transferID})
+		if err != nil {
+			return TransferResult{}, err
+		}
+		if offset = resp.Offset; offset > size {
+			offset = 0
+		}
+		// the checksum covers the whole file, including the part sent before
+		if _, err = io.CopyN(checksum, reader, offset); err != nil {
+			return TransferResult{}, err
+		}
+		mdMap[transferIDKey] = transferID
+		mdMap[offsetKey] = strconv.FormatInt(offset, 10)
+	}
+	return d.streamUpload(reader, mdMap, checksum, offset, size, options)
+}
+
+// UploadReader uploads the data of `reader`, of a size unknown, as remote file `name`. An
+// existing directory is no destination, the data have no name to be saved under in it.
+func (d *defaultClient) UploadReader(reader io.Reader, name string, options TransferOptions) (TransferResult, error) {
+	if options.Resume || options.Parallel > 1 || options.Delta || options.Tar {
+		return TransferResult{}, errors.New("a stream is uploaded whole, without --resume, --parallel, --delta or --tar")
+	}
+	if name == "" || strings.HasSuffix(name, "/") || d.remoteDir(name) == nil {
+		return TransferResult{}, errors.New("name the remote file the stream is saved as, not a directory")
+	}
+	if options.Conflict == ConflictSkip {
+		if stat, err := d.Stat(name, StatOptions{}); err == nil {
+			return TransferResult{Path: stat.Path, Skipped: true}, nil
+		}
+	}
+
+	var mdMap = map[string]string{"name": name, "type": fileType}
+	if options.Conflict != "" {
+		mdMap[conflictKey] = string(options.Conflict)
+	}
+	if accept := d.acceptCompression(name, false); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
 	if err != nil {
-		return err
+		return TransferResult{}, err
 	}
-	defer file.Close()
+	return d.streamUpload(reader, mdMap, checksum, 0, -1, options)
+}
 
+// streamUpload uploads the data of `reader` from `offset` as the upload of `mdMap`, `size`
+// is the size of all data, negative if unknown. The data are written to `checksum`.
+func (d *defaultClient) streamUpload(reader io.Reader, mdMap map[string]string, checksum *pkg.Checksum,
+	offset int64, size int64, options TransferOptions) (TransferResult, error) {
 	// prepare metadata and grpc stream
-	md := metadata.New(mdMap)
-	ctx := metadata.NewOutgoingContext(context.Background(), md)
-	stream, err := d.grpcClient.UploadFile(ctx)
+	stream, err := d.grpcClient.UploadFile(d.context(mdMap))
 	if err != nil {
-		return err
+		return TransferResult{}, err
 	}
 
 	// prepare process bar
 	var pushCh = make(chan int64, 2)
 	var procCtx, cancel = context.WithCancel(context.Background())
-	defer func() {
+	defer cancel()
+	procBar := processBar("upload", offset, size, pushCh, procCtx, options)
+
+	reader = io.TeeReader(reader, io.MultiWriter(checksum, progressWriter{push: pushCh}))
+	resp, header, sent, err := d.sendUpload(stream, reader, checksum)
+	if err != nil || (size >= 0 && offset+sent < size) {
+		// the source shrank or the server ended the upload early, the bar would never finish
 		cancel()
-		close(pushCh)
-	}()
-	procBar, _ := pkg.ProcessBar("upload", 0, info.Size(), pushCh, procCtx)
+	}
+	// a bar of unknown size ends with the data
+	close(pushCh)
+	<-procBar
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	if err = d.updateSession(header); err != nil {
+		return TransferResult{}, err
+	}
+	if resp.Skipped {
+		return TransferResult{Path: resp.Path, Skipped: true}, nil
+	}
+	if resp.Checksum != checksum.String() {
+		return TransferResult{}, fmt.Errorf("checksum mismatch: expect %q, got %q", checksum, resp.Checksum)
+	}
+	return TransferResult{Path: resp.Path, Checksum: checksum.String()}, nil
+}
+
+// sendUpload sends the data of `reader` through an upload stream compressed as negotiated,
+// followed by `checksum` which the caller computes. It returns the response, the header
+// of the server and the bytes sent.
+func (d *defaultClient) sendUpload(stream GotService_UploadFileClient, reader io.Reader,
+	checksum *pkg.Checksum) (*UploadFileResponse, metadata.MD, int64, error) {
+	// the server answers with the compression to use and its max message size
+	header, err := stream.Header()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var compression string
+	if c := header.Get(compressionKey); c != nil {
+		compression = c[0]
+	}
+	limit := peerChunkLimit(chunkLimit(d.config.MaxMessageSize), header.Get(maxMessageSizeKey))
+	output, err := compressWriter(compression, &messageWriter{size: limit, send: func(p []byte) error {
+		return stream.Send(&UploadFileRequest{Data: p})
+	}})
+	if err != nil {
+		return nil, nil, 0, err
+	}
 
-	// data transfer
-	chunk := make([]byte, 4*(1<<10))
+	sizer := newChunkSizer(d.config.ChunkSize, d.config.AdaptiveChunkSize, limit)
+	defer sizer.release()
+	var sent int64
 	for {
-		n, err := file.Read(chunk)
+		chunk := sizer.chunk()
+		n, err := io.ReadFull(reader, chunk)
 		if err == io.EOF {
 			break
-		} else if err != nil {
-			cancel()
-			return err
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, sent, err
 		}
-		if n < len(chunk) {
-			chunk = chunk[:n]
+		_, err = output.Write(chunk[:n])
+		if errors.Is(err, io.EOF) {
+			// the server ended the upload early, the reason comes with CloseAndRecv
+			break
+		} else if err != nil {
+			return nil, nil, sent, err
 		}
-		err = stream.Send(&UploadFileRequest{Data: chunk})
-		if err != nil {
-			cancel()
-			return err
+		sent += int64(n)
+		sizer.sent(n)
+	}
+
+	// flush compressed data, send checksum and close stream, the server verifies the checksum
+	err = output.Close()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, sent, err
+	}
+	err = stream.Send(&UploadFileRequest{Checksum: checksum.String()})
+	if err != nil && err != io.EOF {
+		return nil, nil, sent, err
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, nil, sent, err
+	}
+	return resp, header, sent, nil
+}
+
+// transferID identifies the upload of a file as `name`, it stays the same as long as the
+// source is unchanged so an interrupted upload can be resumed.
+func (d *defaultClient) transferID(filePath string, name string, info os.FileInfo, size int64) (string, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%d",
+		d.addr, absPath, name, size, info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// DownloadFile downloads remote file or directory `filePath` to local path `dst`. An
+// existing directory or a `dst` ending with a separator receives it under its base name,
+// the working directory if `dst` is empty.
+func (d *defaultClient) DownloadFile(filePath string, dst string, options TransferOptions) (TransferResult, error) {
+	target := localTarget(filePath, dst)
+	if !options.Tar {
+		// a directory is downloaded file by file, other files and servers without manifests
+		// continue with a single stream
+		var header metadata.MD
+		resp, err := d.grpcClient.DownloadManifest(d.context(nil),
+			&DownloadManifestRequest{Name: filePath}, grpc.Header(&header))
+		switch status.Code(err) {
+		case codes.OK:
+			if err = d.updateSession(header); err != nil {
+				return TransferResult{}, err
+			}
+			return d.downloadDir(filePath, target, resp.Entries, options)
+		case codes.FailedPrecondition, codes.Unimplemented:
+		default:
+			return TransferResult{}, err
 		}
-		pushCh <- int64(len(chunk))
 	}
-	<-procBar
+	return d.downloadFile(filePath, target, options)
+}
 
-	// close stream
-	_, err = stream.CloseAndRecv()
-	return err
+// localTarget returns the local path remote `filePath` is downloaded to for destination `dst`.
+func localTarget(filePath string, dst string) string {
+	base := path.Base(filepath.ToSlash(filePath))
+	if dst == "" {
+		return base
+	}
+	if strings.HasSuffix(dst, "/") || strings.HasSuffix(dst, string(filepath.Separator)) {
+		return filepath.Join(dst, base)
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		return filepath.Join(dst, base)
+	}
+	return dst
 }
 
-func (d *defaultClient) DownloadFile(filePath string) error {
-	stream, err := d.grpcClient.DownloadFile(context.Background(),
-		&DownloadFileRequest{Filepath: filePath})
+// downloadFile downloads file or directory `filePath` to local path `target` over a single
+// stream, a large file over options.Parallel streams, or a file by its delta to the
+// existing destination.
+func (d *defaultClient) downloadFile(filePath string, target string, options TransferOptions) (TransferResult, error) {
+	if options.Delta {
+		if result, err := d.downloadDelta(filePath, target, options); err != errNoBase {
+			return result, err
+		}
+	}
+	if options.Parallel > 1 {
+		return d.downloadParallel(filePath, target, options)
+	}
+	partPath := target + partialSuffix
+
+	// a resumable download continues the partial file left by an interrupted run of the
+	// same source, the server verifies it with the checksum of the whole file at the end
+	var offset int64
+	var partial partialDownload
+	if options.Resume {
+		if p, err := loadPartialDownload(partPath); err == nil && p.Source == filePath {
+			if info, err := os.Stat(partPath); err == nil {
+				offset = info.Size()
+				partial = p
+			}
+		}
+	}
+
+	var mdMap = make(map[string]string)
+	if accept := d.acceptCompression(filePath, false); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
+	if options.Resume {
+		mdMap[fileChecksumKey] = "true"
+	}
+	ctx, cancelStream := context.WithCancel(d.context(mdMap))
+	defer cancelStream()
+	stream, err := d.grpcClient.DownloadFile(ctx,
+		&DownloadFileRequest{Filepath: filePath, Offset: offset})
 	if err != nil {
-		return err
+		return TransferResult{}, err
 	}
 
 	// get metadata from header
 	md, err := stream.Header()
 	if err != nil {
-		return err
+		return TransferResult{}, err
 	}
 	if e := md.Get("err"); e != nil {
-		return errors.New(e[0])
+		return TransferResult{}, errors.New(e[0])
+	}
+	if err = d.updateSession(md); err != nil {
+		return TransferResult{}, err
 	}
-	// get size
-	var size int64
+	// get size and modification time
+	var size, mtime int64
 	if s := md.Get("size"); s != nil {
 		size, err = strconv.ParseInt(s[0], 0, 64)
 		if err != nil {
-			return err
+			return TransferResult{}, err
+		}
+	}
+	if m := md.Get("mtime"); m != nil {
+		mtime, err = strconv.ParseInt(m[0], 0, 64)
+		if err != nil {
+			return TransferResult{}, err
 		}
 	}
+	// the remote file changed since the partial download, start over
+	if offset > 0 && (partial.Size != size || partial.Mtime != mtime) {
+		cancelStream()
+		removePartialDownload(partPath)
+		return d.downloadFile(filePath, target, options)
+	}
 	// get download file's type
 	var downloadType string
 	if t := md.Get("type"); t != nil {
-		if t[0] == dirType {
-			filePath = fmt.Sprintf("%s.tar", filePath)
-		}
 		downloadType = t[0]
 	}
+	resumable := options.Resume && downloadType == fileType
+	var compression string
+	if c := md.Get(compressionKey); c != nil {
+		compression = c[0]
+	}
+
+	// apply the conflict policy
+	target, skip, err := resolveConflict(target, options.Conflict)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if skip {
+		return TransferResult{Path: target, Skipped: true}, nil
+	}
 
-	// new file for receiving
-	file, err := os.OpenFile(filepath.Base(filePath), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	// checksum covers the whole file, rangeChecksum the data received in this run
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	rangeChecksum, _ := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+
+	// output for receiving: a resumable download is received into a partial file recorded
+	// with the size and mtime of its source, a directory is extracted while being received,
+	// and a file is received into a temporary file renamed to the destination on success
+	var output io.Writer
+	var file *os.File
+	var atomicFile *pkg.AtomicFile
+	var extractor *dirExtractor
+	switch {
+	case resumable:
+		err = savePartialDownload(partPath, partialDownload{Source: filePath, Size: size, Mtime: mtime})
+		if err != nil {
+			return TransferResult{}, err
+		}
+		file, err = openPartialDownload(partPath, offset, checksum)
+		if err == nil {
+			defer file.Close()
+			output = file
+		}
+	case downloadType == dirType:
+		extractor, err = newDirExtractor(target, pkg.DefaultUnTarLimits)
+		if err == nil {
+			defer extractor.abort()
+			output = extractor
+		}
+	default:
+		atomicFile, err = pkg.CreateAtomic(target, 0666)
+		if err == nil {
+			defer atomicFile.Abort()
+			output = atomicFile
+		}
+	}
 	if err != nil {
 		log.Println(err)
-		return err
+		return TransferResult{}, err
 	}
-	defer func() {
-		_ = file.Close()
-		// if the specified download is a directory, remove temporary tar file
-		if downloadType == dirType {
-			err = os.Remove(filePath)
+	discard := func() {
+		if resumable {
+			_ = file.Close()
+			removePartialDownload(partPath)
 		}
-	}()
+	}
 
 	// prepare process bar
 	var pushCh = make(chan int64, 2)
@@ -203,33 +734,211 @@ func (d *defaultClient) DownloadFile(filePath string) error {
 		cancel()
 		close(pushCh)
 	}()
-	procBar, _ := pkg.ProcessBar("download", 0, size, pushCh, procCtx)
+	procBar := processBar("download", offset, size, pushCh, procCtx, options)
 
-	// receive data
-	for {
+	// receive data, partial data of a resumable download are kept on failure.
+	// progress and checksum count the uncompressed data
+	reader, err := decompressReader(compression, &messageReader{recv: func() ([]byte, error) {
 		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Data, nil
+	}})
+	if err != nil {
+		cancel()
+		return TransferResult{}, err
+	}
+	defer reader.Close()
+	writer := io.MultiWriter(output, checksum, rangeChecksum)
+	chunk := getChunk(DefaultChunkSize)
+	defer putChunk(chunk)
+	received := offset
+	for {
+		// a decompressor may return the last data together with io.EOF
+		n, err := reader.Read(chunk)
+		if n > 0 {
+			if _, err := writer.Write(chunk[:n]); err != nil {
+				cancel()
+				return TransferResult{}, err
+			}
+			received += int64(n)
+			pushCh <- int64(n)
+		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			_ = os.Remove(file.Name())
-			cancel()
-			return err
-		}
-		_, err = file.Write(resp.Data)
-		if err != nil {
-			_ = os.Remove(file.Name())
 			cancel()
-			return err
+			return TransferResult{}, err
 		}
-		pushCh <- int64(len(resp.Data))
+	}
+	if received < size {
+		// the source shrank while being sent, the bar would never finish
+		cancel()
 	}
 	<-procBar
 
-	// if the specified download is a directory, unpack the tar file as a directory
-	if downloadType == dirType {
-		if err = pkg.UnTar(filePath, "."); err != nil {
-			return err
+	// verify the checksum sent by the server in trailer
+	var expected string
+	if c := stream.Trailer().Get(checksumKey); c != nil {
+		expected = c[0]
+	}
+	if expected != rangeChecksum.String() {
+		discard()
+		return TransferResult{}, fmt.Errorf("checksum mismatch: expect %q, got %q", expected, rangeChecksum)
+	}
+	// a resumed file is assembled from the data of several runs, verify it as a whole with
+	// the checksum of the server, older servers send none
+	if c := stream.Trailer().Get(fileChecksumKey); resumable && c != nil && c[0] != checksum.String() {
+		discard()
+		return TransferResult{}, fmt.Errorf("checksum mismatch: expect %q, got %q", c[0], checksum)
+	}
+
+	// the download is complete and verified, move it to its destination
+	switch {
+	case resumable:
+		if err = file.Close(); err == nil {
+			if err = os.Rename(partPath, target); err == nil {
+				removePartialDownload(partPath)
+			}
 		}
+	case downloadType == dirType:
+		err = extractor.commit()
+	default:
+		err = atomicFile.Commit()
 	}
-	return err
+	if err != nil {
+		return TransferResult{}, err
+	}
+	return TransferResult{Path: target, Checksum: checksum.String()}, nil
+}
+
+// ReadRange writes `length` bytes of remote file `filePath` from `offset` to `w`,
+// up to the end of the file if `length` is 0. It returns the number of bytes written.
+func (d *defaultClient) ReadRange(filePath string, offset int64, length int64, w io.Writer) (int64, error) {
+	written, _, err := d.readRange(context.Background(), filePath, offset, length, w, func(md metadata.MD) error {
+		if t := md.Get("type"); t != nil && t[0] == dirType {
+			return fmt.Errorf("%s is a directory", filePath)
+		}
+		return nil
+	})
+	return written, err
+}
+
+// readRange writes a range of remote file `filePath` to `w` as ReadRange, the response
+// header is checked by `check` before any data are written. It returns the number of
+// bytes written and the checksum of the range sent by the server, which they match.
+func (d *defaultClient) readRange(ctx context.Context, filePath string, offset int64, length int64, w io.Writer,
+	check func(md metadata.MD) error) (int64, string, error) {
+	var mdMap = make(map[string]string)
+	if accept := d.acceptCompression(filePath, false); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
+	stream, err := d.grpcClient.DownloadFile(d.outgoingContext(ctx, mdMap),
+		&DownloadFileRequest{Filepath: filePath, Offset: offset, Length: length})
+	if err != nil {
+		return 0, "", err
+	}
+	md, err := stream.Header()
+	if err != nil {
+		return 0, "", err
+	}
+	if e := md.Get("err"); e != nil {
+		return 0, "", errors.New(e[0])
+	}
+	if err = check(md); err != nil {
+		return 0, "", err
+	}
+	if err = d.updateSession(md); err != nil {
+		return 0, "", err
+	}
+	var compression string
+	if c := md.Get(compressionKey); c != nil {
+		compression = c[0]
+	}
+
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return 0, "", err
+	}
+	reader, err := decompressReader(compression, &messageReader{recv: func() ([]byte, error) {
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Data, nil
+	}})
+	if err != nil {
+		return 0, "", err
+	}
+	defer reader.Close()
+	buf := getChunk(DefaultChunkSize)
+	defer putChunk(buf)
+	written, err := io.CopyBuffer(io.MultiWriter(w, checksum), reader, buf)
+	if err != nil {
+		return written, "", err
+	}
+
+	var expected string
+	if c := stream.Trailer().Get(checksumKey); c != nil {
+		expected = c[0]
+	}
+	if expected != checksum.String() {
+		return written, "", fmt.Errorf("checksum mismatch: expect %q, got %q", expected, checksum)
+	}
+	return written, expected, nil
+}
+
+const partialSuffix = ".part"
+
+// partialDownload is the sidecar of a partial download, recording the remote source
+// the partial data belong to.
+type partialDownload struct {
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+	Mtime  int64  `json:"mtime"`
+}
+
+func sidecarPath(partPath string) string {
+	return partPath + ".json"
+}
+
+func loadPartialDownload(partPath string) (partialDownload, error) {
+	var partial partialDownload
+	data, err := os.ReadFile(sidecarPath(partPath))
+	if err != nil {
+		return partial, err
+	}
+	return partial, json.Unmarshal(data, &partial)
+}
+
+func savePartialDownload(partPath string, partial partialDownload) error {
+	data, err := json.Marshal(partial)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarPath(partPath), data, 0644)
+}
+
+func removePartialDownload(partPath string) {
+	_ = os.Remove(partPath)
+	_ = os.Remove(sidecarPath(partPath))
+}
+
+// openPartialDownload opens the partial file positioned at `offset`,
+// with the data before `offset` written to `checksum`.
+func openPartialDownload(partPath string, offset int64, checksum io.Writer) (*os.File, error) {
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if _, err = io.CopyN(checksum, file, offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
 }
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"got/pkg"
+	"io"
+	"strings"
+)
+
+const acceptCompressionKey = "accept-compression"
+const compressionKey = "compression"
+
+// Compression choices of the client besides the algorithms of pkg.CompressionAlgorithms.
+const (
+	// CompressionNone transfers data uncompressed
+	CompressionNone = "none"
+	// CompressionAuto offers every supported algorithm, except for already compressed files
+	CompressionAuto = "auto"
+)
+
+// ParseCompression checks the compression choice `s` of the client, CompressionNone if empty.
+func ParseCompression(s string) (string, error) {
+	switch s {
+	case "":
+		return CompressionNone, nil
+	case CompressionNone, CompressionAuto:
+		return s, nil
+	}
+	for _, algorithm := range pkg.CompressionAlgorithms() {
+		if s == algorithm {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("unknown compression %q", s)
+}
+
+// negotiateCompression returns the first algorithm offered by the client which is
+// in `supported`, and whether the client offered any.
+func negotiateCompression(ctx context.Context, supported []string) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || md.Get(acceptCompressionKey) == nil {
+		return "", false
+	}
+	for _, offer := range strings.Split(md.Get(acceptCompressionKey)[0], ",") {
+		for _, algorithm := range supported {
+			if offer == algorithm {
+				return algorithm, true
+			}
+		}
+	}
+	return "", true
+}
+
+// messageReader reads the data of a stream of messages.
+type messageReader struct {
+	recv func() ([]byte, error)
+	buf  []byte
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		data, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// messageWriter sends written data as messages of at most `size` bytes.
+type messageWriter struct {
+	send func([]byte) error
+	size int
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.size {
+			n = w.size
+		}
+		if err := w.send(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close does nothing, it makes messageWriter the uncompressed counterpart of a compressor.
+func (w *messageWriter) Close() error {
+	return nil
+}
+
+// compressWriter returns a writer sending the data compressed with `algorithm` through `w`,
+// `w` itself if `algorithm` is empty.
+func compressWriter(algorithm string, w *messageWriter) (io.WriteCloser, error) {
+	if algorithm == "" {
+		return w, nil
+	}
+	return pkg.NewCompressor(algorithm, w)
+}
+
+// decompressReader returns a reader of the data of `r` compressed with `algorithm`,
+// `r` itself if `algorithm` is empty.
+func decompressReader(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	if algorithm == "" {
+		return io.NopCloser(r), nil
+	}
+	return pkg.NewDecompressor(algorithm, r)
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const conflictKey = "conflict"
+
+// ConflictPolicy decides what the receiver does when the destination of a transfer exists.
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite replaces an existing file, a directory is merged into the existing one
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip keeps the existing destination and skips the transfer
+	ConflictSkip ConflictPolicy = "skip-existing"
+	// ConflictRename saves the transfer under a new name like `name (1).ext`
+	ConflictRename ConflictPolicy = "rename"
+	// ConflictFail fails the transfer
+	ConflictFail ConflictPolicy = "fail-if-exists"
+)
+
+// ParseConflictPolicy returns the policy named `s`, ConflictOverwrite if empty.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case "":
+		return ConflictOverwrite, nil
+	case ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// errExists is returned by resolveConflict for ConflictFail.
+type errExists string
+
+func (e errExists) Error() string {
+	return string(e) + " already exists"
+}
+
+// resolveConflict returns the path the transfer to `path` should be saved to under
+// `policy`, and whether the transfer should be skipped.
+func resolveConflict(path string, policy ConflictPolicy) (string, bool, error) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path, false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	switch policy {
+	case ConflictSkip:
+		return path, true, nil
+	case ConflictRename:
+		return uniquePath(path), false, nil
+	case ConflictFail:
+		return "", false, errExists(path)
+	}
+	return path, false, nil
+}
+
+// uniquePath returns the first of `name (1).ext`, `name (2).ext`, ... which does not exist.
+func uniquePath(path string) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", name, i, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	tests := []struct {
+		s    string
+		want ConflictPolicy
+	}{
+		{s: "", want: ConflictOverwrite},
+		{s: "overwrite", want: ConflictOverwrite},
+		{s: "skip-existing", want: ConflictSkip},
+		{s: "rename", want: ConflictRename},
+		{s: "fail-if-exists", want: ConflictFail},
+		{s: "skip"},
+		{s: "Overwrite"},
+	}
+	for _, test := range tests {
+		got, err := ParseConflictPolicy(test.s)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("ParseConflictPolicy(%q) = %q, want an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseConflictPolicy(%q) = %q, %v, want %q", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"f.txt", "g.txt", "g (1).txt", "g (3).txt", "noext", "a.tar.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a dangling symlink exists as well
+	if err := os.Symlink("missing", filepath.Join(dir, "dangling")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		policy ConflictPolicy
+		want   string
+		skip   bool
+		exists bool
+	}{
+		{name: "missing overwrite", path: "new.txt", policy: ConflictOverwrite, want: "new.txt"},
+		{name: "missing skip", path: "new.txt", policy: ConflictSkip, want: "new.txt"},
+		{name: "missing rename", path: "new.txt", policy: ConflictRename, want: "new.txt"},
+		{name: "missing fail", path: "new.txt", policy: ConflictFail, want: "new.txt"},
+		{name: "existing overwrite", path: "f.txt", policy: ConflictOverwrite, want: "f.txt"},
+		{name: "existing skip", path: "f.txt", policy: ConflictSkip, want: "f.txt", skip: true},
+		{name: "existing fail", path: "f.txt", policy: ConflictFail, exists: true},
+		{name: "directory fail", path: "d", policy: ConflictFail, exists: true},
+		{name: "dangling symlink skip", path: "dangling", policy: ConflictSkip, want: "dangling", skip: true},
+		{name: "rename", path: "f.txt", policy: ConflictRename, want: "f (1).txt"},
+		{name: "rename takes the first free number", path: "g.txt", policy: ConflictRename, want: "g (2).txt"},
+		{name: "rename without extension", path: "noext", policy: ConflictRename, want: "noext (1)"},
+		{name: "rename keeps the last extension", path: "a.tar.gz", policy: ConflictRename, want: "a.tar (1).gz"},
+		{name: "rename directory", path: "d", policy: ConflictRename, want: "d (1)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, skip, err := resolveConflict(filepath.Join(dir, test.path), test.policy)
+			if test.exists {
+				if _, ok := err.(errExists); !ok {
+					t.Fatalf("resolveConflict = %q, %v, %v, want errExists", got, skip, err)
+				}
+				return
+			}
+			if want := filepath.Join(dir, test.want); err != nil || got != want || skip != test.skip {
+				t.Fatalf("resolveConflict = %q, %v, %v, want %q, %v", got, skip, err, want, test.skip)
+			}
+		})
+	}
+}
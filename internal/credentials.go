@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"got/pkg"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ConfigDir returns the directory holding got's certificates and known hosts,
+// creating it if necessary.
+func ConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "got")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// SelfSignedCert returns the certificate and key files of the server's self-signed
+// certificate in `dir`, generating them on first use.
+func SelfSignedCert(dir string) (string, string, error) {
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if _, err := os.Stat(certFile); err == nil {
+		if _, err = os.Stat(keyFile); err == nil {
+			return certFile, keyFile, nil
+		}
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				hosts = append(hosts, ipNet.IP.String())
+			}
+		}
+	}
+	return certFile, keyFile, pkg.GenerateSelfSignedCert(certFile, keyFile, hosts)
+}
+
+func serverCredentials(config ServerConfig) (credentials.TransportCredentials, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("TLS certificate and key must be both specified")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// mutual TLS, only clients holding a certificate signed by the client CA are accepted,
+	// the certificate becomes optional when clients may authenticate by token instead
+	if config.ClientCAFile != "" {
+		pool, err := loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.TokensFile != "" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func clientCredentials(addr string, config ClientConfig) (credentials.TransportCredentials, error) {
+	if config.Insecure {
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+		return credentials.NewTLS(tlsConfig), nil
+	}
+
+	// no CA given, trust the server on first use and pin its fingerprint
+	knownHosts := &knownHosts{path: config.KnownHostsFile}
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		return knownHosts.verify(addr, pkg.Fingerprint(rawCerts[0]))
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// certIdentity returns the caller identity of a client certificate,
+// the subject CN or else the first SAN.
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// knownHosts is the trust-on-first-use store of server fingerprints,
+// one `<addr> <fingerprint>` pair per line.
+type knownHosts struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (k *knownHosts) verify(addr string, fingerprint string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	file, err := os.OpenFile(k.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != addr {
+			continue
+		}
+		if fields[1] != fingerprint {
+			return fmt.Errorf("certificate of %s has changed to %s, "+
+				"remove its entry from %s if this is expected", addr, fingerprint, k.path)
+		}
+		return nil
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "trusting new server %s with fingerprint %s\n", addr, fingerprint)
+	_, err = fmt.Fprintf(file, "%s %s\n", addr, fingerprint)
+	return err
+}
@@ -0,0 +1,484 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"got/pkg"
+	"io"
+	"os"
+	"strconv"
+)
+
+// deltaKey marks an upload whose data are a delta to the existing file, its value is the block size.
+const deltaKey = "delta"
+
+// blockMessageSize is the space a block signature takes at most in a message.
+const blockMessageSize = 32
+
+// errNoBase is returned when there is no copy of a file to transfer the delta to,
+// the file is transferred whole instead.
+var errNoBase = errors.New("no base for delta")
+
+// openBase opens the existing regular file at `path` a delta is computed against.
+func openBase(path string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, status.Errorf(codes.NotFound, "%s does not exist", path)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		_ = file.Close()
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "%s is not a regular file", path)
+	}
+	return file, info, nil
+}
+
+// sendSignature passes the blocks of `signature` to `send` in batches fitting in messages
+// of `limit` bytes, at least one batch is sent.
+func sendSignature(signature *pkg.Signature, limit int, send func(blocks []*BlockSignature) error) error {
+	batch := limit / blockMessageSize
+	if batch < 1 {
+		batch = 1
+	}
+	var blocks []*BlockSignature
+	for _, block := range signature.Blocks {
+		blocks = append(blocks, &BlockSignature{Weak: block.Weak, Strong: block.Strong})
+		if len(blocks) == batch {
+			if err := send(blocks); err != nil {
+				return err
+			}
+			blocks = nil
+		}
+	}
+	if len(blocks) > 0 || len(signature.Blocks) == 0 {
+		return send(blocks)
+	}
+	return nil
+}
+
+// appendSignature appends the blocks of a message to `signature`.
+func appendSignature(signature *pkg.Signature, blockSize int64, blocks []*BlockSignature) error {
+	if err := pkg.CheckBlockSize(blockSize); err != nil {
+		return err
+	}
+	if signature.BlockSize != 0 && int64(signature.BlockSize) != blockSize {
+		return fmt.Errorf("block size changed from %d to %d", signature.BlockSize, blockSize)
+	}
+	signature.BlockSize = int(blockSize)
+	if len(signature.Blocks)+len(blocks) > pkg.MaxSignatureBlocks {
+		return fmt.Errorf("more than %d blocks", pkg.MaxSignatureBlocks)
+	}
+	for _, block := range blocks {
+		signature.Blocks = append(signature.Blocks, pkg.BlockSignature{Weak: block.Weak, Strong: block.Strong})
+	}
+	return nil
+}
+
+// deltaStatus maps the rejection of a delta to a gRPC status.
+func deltaStatus(err error) error {
+	if errors.Is(err, pkg.ErrInvalidDelta) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
+}
+
+// countingReader counts the bytes read from `r`.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (d *defaultServer) FileSignature(req *FileSignatureRequest, stream GotService_FileSignatureServer) error {
+	logCall(stream.Context(), "FileSignature")
+
+	path, err := d.resolve(stream.Context(), req.Name)
+	if err != nil {
+		return err
+	}
+	file, info, err := openBase(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var limit = chunkLimit(d.config.MaxMessageSize)
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		limit = peerChunkLimit(limit, md.Get(maxMessageSizeKey))
+	}
+
+	blockSize := pkg.BlockSize(info.Size())
+	signature, err := pkg.NewSignature(file, blockSize)
+	if err != nil {
+		return err
+	}
+	return sendSignature(signature, limit, func(blocks []*BlockSignature) error {
+		return stream.Send(&FileSignatureResponse{BlockSize: int64(blockSize), Blocks: blocks})
+	})
+}
+
+func (d *defaultServer) DownloadDelta(stream GotService_DownloadDeltaServer) error {
+	logCall(stream.Context(), "DownloadDelta")
+
+	// the signature of the client's copy comes first
+	var filePath string
+	signature := &pkg.Signature{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if req.Filepath != "" {
+			filePath = req.Filepath
+		}
+		if err = appendSignature(signature, req.BlockSize, req.Blocks); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if err := pkg.CheckBlockSize(int64(signature.BlockSize)); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	path, err := d.resolve(stream.Context(), filePath)
+	if err != nil {
+		return err
+	}
+	file, info, err := openBase(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var algorithm string
+	var limit = chunkLimit(d.config.MaxMessageSize)
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if a := md.Get(checksumAlgorithmKey); a != nil {
+			algorithm = a[0]
+		}
+		limit = peerChunkLimit(limit, md.Get(maxMessageSizeKey))
+	}
+	checksum, err := pkg.NewChecksum(algorithm)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	header := metadata.Pairs(
+		"type", fileType,
+		"size", strconv.FormatInt(info.Size(), 10),
+		"mtime", strconv.FormatInt(info.ModTime().UnixNano(), 10),
+	)
+	compression, _ := negotiateCompression(stream.Context(), d.config.Compression)
+	if compression != "" {
+		header.Set(compressionKey, compression)
+	}
+	if err = stream.SetHeader(header); err != nil {
+		return err
+	}
+
+	// the checksum covers the whole file, the client verifies the file it rebuilds
+	output, err := compressWriter(compression, &messageWriter{size: limit, send: func(p []byte) error {
+		return stream.Send(&DownloadFileResponse{Data: p})
+	}})
+	if err != nil {
+		return err
+	}
+	if err = pkg.WriteDelta(signature, io.TeeReader(file, checksum), output); err != nil {
+		return err
+	}
+	if err = output.Close(); err != nil {
+		return err
+	}
+	stream.SetTrailer(metadata.Pairs(checksumKey, checksum.String()))
+	return nil
+}
+
+// fileSignature returns the signature of the copy of `name` on the server, errNoBase if
+// the server has none.
+func (d *defaultClient) fileSignature(ctx context.Context, name string) (*pkg.Signature, error) {
+	stream, err := d.grpcClient.FileSignature(d.outgoingContext(ctx, nil), &FileSignatureRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	signature := &pkg.Signature{}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		switch status.Code(err) {
+		case codes.OK:
+		case codes.NotFound, codes.FailedPrecondition, codes.Unimplemented:
+			return nil, errNoBase
+		default:
+			return nil, err
+		}
+		if err = appendSignature(signature, resp.BlockSize, resp.Blocks); err != nil {
+			return nil, err
+		}
+	}
+	return signature, nil
+}
+
+// sendDelta uploads the data of `reader` as the upload of `mdMap`, by its delta to the copy
+// on the server described by `signature`. The data are written to `checksum` and their size
+// to `push`. It returns the response, the header of the server and the bytes read.
+func (d *defaultClient) sendDelta(ctx context.Context, signature *pkg.Signature, reader io.Reader,
+	mdMap map[string]string, checksum *pkg.Checksum, push chan<- int64) (*UploadFileResponse, metadata.MD, int64, error) {
+	var deltaMap = map[string]string{deltaKey: strconv.Itoa(signature.BlockSize)}
+	for k, v := range mdMap {
+		deltaMap[k] = v
+	}
+	stream, err := d.grpcClient.UploadFile(d.outgoingContext(ctx, deltaMap))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// the delta is computed while being sent
+	source := &countingReader{r: io.TeeReader(reader, io.MultiWriter(checksum, progressWriter{push: push}))}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = pw.CloseWithError(pkg.WriteDelta(signature, source, pw))
+	}()
+	resp, header, _, err := d.sendUpload(stream, pr, checksum)
+	_ = pr.Close()
+	<-done
+	if err != nil {
+		return nil, nil, source.n, err
+	}
+	return resp, header, source.n, nil
+}
+
+// uploadDelta uploads file `filePath` as remote path `name` by its delta to the copy on the
+// server, errNoBase if the server has none.
+func (d *defaultClient) uploadDelta(filePath string, name string, info os.FileInfo,
+	options TransferOptions) (TransferResult, error) {
+	signature, err := d.fileSignature(context.Background(), name)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	defer file.Close()
+
+	var mdMap = map[string]string{
+		"name": name,
+		"type": fileType,
+	}
+	if options.Conflict != "" {
+		mdMap[conflictKey] = string(options.Conflict)
+	}
+	if accept := d.acceptCompression(filePath, false); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	// prepare process bar
+	var pushCh = make(chan int64, 2)
+	var procCtx, cancel = context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		close(pushCh)
+	}()
+	procBar := processBar("upload", 0, info.Size(), pushCh, procCtx, options)
+
+	resp, header, read, err := d.sendDelta(context.Background(), signature, file, mdMap, checksum, pushCh)
+	if err != nil {
+		cancel()
+		return TransferResult{}, err
+	}
+	if read < info.Size() {
+		// the source shrank or the server ended the upload early, the bar would never finish
+		cancel()
+	}
+	<-procBar
+
+	if err = d.updateSession(header); err != nil {
+		return TransferResult{}, err
+	}
+	if resp.Skipped {
+		return TransferResult{Path: resp.Path, Skipped: true}, nil
+	}
+	if resp.Checksum != checksum.String() {
+		return TransferResult{}, fmt.Errorf("checksum mismatch: expect %q, got %q", checksum, resp.Checksum)
+	}
+	return TransferResult{Path: resp.Path, Checksum: checksum.String()}, nil
+}
+
+// readDelta writes remote file `filePath` rebuilt from its delta to local copy `base` of
+// `size` bytes to `w` and `checksum`, the response header is checked by `check` before
+// any data are written. It returns errNoBase if the remote file is not a regular file.
+func (d *defaultClient) readDelta(ctx context.Context, filePath string, base io.ReaderAt, size int64, w io.Writer,
+	checksum *pkg.Checksum, check func(md metadata.MD) error) (int64, error) {
+	blockSize := pkg.BlockSize(size)
+	signature, err := pkg.NewSignature(io.NewSectionReader(base, 0, size), blockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var mdMap = make(map[string]string)
+	if accept := d.acceptCompression(filePath, false); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := d.grpcClient.DownloadDelta(d.outgoingContext(ctx, mdMap))
+	if err != nil {
+		return 0, err
+	}
+	first := true
+	err = sendSignature(signature, chunkLimit(d.config.MaxMessageSize), func(blocks []*BlockSignature) error {
+		req := &DownloadDeltaRequest{BlockSize: int64(blockSize), Blocks: blocks}
+		if first {
+			req.Filepath, first = filePath, false
+		}
+		return stream.Send(req)
+	})
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return 0, err
+	}
+
+	// a failure comes without header, its status with the end of the stream
+	md, err := stream.Header()
+	if err == nil && md.Get("type") == nil {
+		if _, err = stream.Recv(); err == nil || err == io.EOF {
+			err = errors.New("no header in response")
+		}
+	}
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.FailedPrecondition, codes.Unimplemented:
+		return 0, errNoBase
+	default:
+		return 0, err
+	}
+	if err = check(md); err != nil {
+		return 0, err
+	}
+	if err = d.updateSession(md); err != nil {
+		return 0, err
+	}
+	var compression string
+	if c := md.Get(compressionKey); c != nil {
+		compression = c[0]
+	}
+
+	reader, err := decompressReader(compression, &messageReader{recv: func() ([]byte, error) {
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Data, nil
+	}})
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	written, err := pkg.ApplyDelta(base, size, blockSize, reader, io.MultiWriter(w, checksum))
+	if err != nil {
+		return written, err
+	}
+	// the trailer follows the end of the delta
+	if _, err = io.Copy(io.Discard, reader); err != nil {
+		return written, err
+	}
+
+	var expected string
+	if c := stream.Trailer().Get(checksumKey); c != nil {
+		expected = c[0]
+	}
+	if expected != checksum.String() {
+		return written, fmt.Errorf("checksum mismatch: expect %q, got %q", expected, checksum)
+	}
+	return written, nil
+}
+
+// downloadDelta downloads file `filePath` to local path `target` by its delta to the
+// existing local file, errNoBase if there is none or the remote one is not a regular file.
+func (d *defaultClient) downloadDelta(filePath string, target string, options TransferOptions) (TransferResult, error) {
+	base, err := os.Open(target)
+	if os.IsNotExist(err) {
+		return TransferResult{}, errNoBase
+	} else if err != nil {
+		return TransferResult{}, err
+	}
+	defer base.Close()
+	info, err := base.Stat()
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return TransferResult{}, errNoBase
+	}
+
+	// apply the conflict policy, a renamed download is rebuilt from the existing file too
+	target, skip, err := resolveConflict(target, options.Conflict)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if skip {
+		return TransferResult{Path: target, Skipped: true}, nil
+	}
+	file, err := pkg.CreateAtomic(target, 0666)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	defer file.Abort()
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	// the process bar starts with the size of the remote file in the header
+	var size int64
+	var pushCh = make(chan int64, 2)
+	var procCtx, cancel = context.WithCancel(context.Background())
+	var procBar <-chan struct{}
+	defer func() {
+		cancel()
+		close(pushCh)
+	}()
+	written, err := d.readDelta(context.Background(), filePath, base, info.Size(),
+		io.MultiWriter(file, progressWriter{push: pushCh}), checksum, func(md metadata.MD) error {
+			size, _ = metadataInt(md, "size")
+			procBar = processBar("download", 0, size, pushCh, procCtx, options)
+			return nil
+		})
+	if err != nil {
+		cancel()
+		return TransferResult{}, err
+	}
+	if written < size {
+		// the source shrank while being sent, the bar would never finish
+		cancel()
+	}
+	<-procBar
+	if err = file.Commit(); err != nil {
+		return TransferResult{}, err
+	}
+	return TransferResult{Path: target, Checksum: checksum.String()}, nil
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// DiskSpace is the space of a filesystem in bytes.
+type DiskSpace struct {
+	// Path is the path on the filesystem the space is reported for
+	Path  string
+	Total int64
+	Free  int64
+	// Available is the free space the server may use, less than Free on filesystems
+	// reserving space for the superuser
+	Available int64
+}
+
+func (d *defaultServer) DiskSpace(ctx context.Context, req *DiskSpaceRequest) (*DiskSpaceResponse, error) {
+	logCall(ctx, "DiskSpace")
+
+	path := d.root.path
+	if req.Path != "" {
+		var err error
+		if path, err = d.resolve(ctx, req.Path); err != nil {
+			return nil, err
+		}
+	}
+	space, err := diskSpace(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskSpaceResponse{Path: path, Total: space.Total, Free: space.Free, Available: space.Available}, nil
+}
+
+// DiskSpace returns the space of the filesystem of remote path `path`, of the root if empty.
+func (d *defaultClient) DiskSpace(path string) (DiskSpace, error) {
+	var header metadata.MD
+	resp, err := d.grpcClient.DiskSpace(d.context(nil), &DiskSpaceRequest{Path: path}, grpc.Header(&header))
+	if err != nil {
+		return DiskSpace{}, err
+	}
+	space := DiskSpace{Path: resp.Path, Total: resp.Total, Free: resp.Free, Available: resp.Available}
+	return space, d.updateSession(header)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package internal
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the space of filesystems is reported where statfs is supported
+func diskSpace(path string) (DiskSpace, error) {
+	return DiskSpace{}, status.Error(codes.Unimplemented, "disk space is not reported on this platform")
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// diskSpace returns the space of the filesystem of `path`.
+func diskSpace(path string) (DiskSpace, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return DiskSpace{}, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	blockSize := int64(stat.Bsize)
+	return DiskSpace{
+		Path:      path,
+		Total:     int64(stat.Blocks) * blockSize,
+		Free:      int64(stat.Bfree) * blockSize,
+		Available: int64(stat.Bavail) * blockSize,
+	}, nil
+}
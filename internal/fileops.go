@@ -0,0 +1,397 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"got/pkg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func (d *defaultServer) Remove(ctx context.Context, req *RemoveRequest) (*RemoveResponse, error) {
+	logCall(ctx, "Remove")
+
+	// a symlink is removed itself, not its target
+	path, err := d.root.resolveEntry(sessionFromContext(ctx).Cwd(), req.Name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", req.Name)
+	} else if err != nil {
+		return nil, err
+	}
+	if info.IsDir() && req.Recursive {
+		err = os.RemoveAll(path)
+	} else if err = os.Remove(path); err != nil && info.IsDir() {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is not an empty directory", req.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RemoveResponse{}, nil
+}
+
+func (d *defaultServer) MakeDir(ctx context.Context, req *MakeDirRequest) (*MakeDirResponse, error) {
+	logCall(ctx, "MakeDir")
+
+	// a path through a file fails to resolve, as creating it would
+	path, err := d.resolve(ctx, req.Name)
+	if err == nil && req.Parents {
+		err = os.MkdirAll(path, os.ModeDir|0755)
+	} else if err == nil {
+		err = os.Mkdir(path, os.ModeDir|0755)
+	}
+	switch {
+	case os.IsExist(err):
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", req.Name)
+	case os.IsNotExist(err):
+		return nil, status.Errorf(codes.NotFound, "parent of %s does not exist", req.Name)
+	case errors.Is(err, syscall.ENOTDIR):
+		return nil, status.Errorf(codes.FailedPrecondition, "a parent of %s is not a directory", req.Name)
+	case err != nil:
+		return nil, err
+	}
+	return &MakeDirResponse{}, nil
+}
+
+func (d *defaultServer) Rename(ctx context.Context, req *RenameRequest) (*RenameResponse, error) {
+	logCall(ctx, "Rename")
+
+	// a symlink is moved itself, not its target
+	src, err := d.root.resolveEntry(sessionFromContext(ctx).Cwd(), req.From)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", req.From)
+	} else if err != nil {
+		return nil, err
+	}
+	target, skip, err := d.destination(ctx, src, req.To, req.Conflict)
+	if err != nil || skip {
+		return &RenameResponse{Path: target, Skipped: skip}, err
+	}
+	if target == src {
+		return &RenameResponse{Path: target}, nil
+	}
+	if info.IsDir() && within(src, target) {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot move %s into itself", req.From)
+	}
+
+	err = os.Rename(src, target)
+	if errors.Is(err, syscall.EXDEV) {
+		// the root spans filesystems, the entry is copied and the source removed
+		if err = d.copyEntry(src, target, info); err == nil {
+			err = os.RemoveAll(src)
+		}
+	}
+	if err != nil {
+		return nil, fileOpStatus(err)
+	}
+	return &RenameResponse{Path: target}, nil
+}
+
+func (d *defaultServer) Copy(ctx context.Context, req *CopyRequest) (*CopyResponse, error) {
+	logCall(ctx, "Copy")
+
+	src, err := d.resolve(ctx, req.From)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", req.From)
+	} else if err != nil {
+		return nil, err
+	}
+	if info.IsDir() && !req.Recursive {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is a directory, copy it recursively", req.From)
+	}
+	target, skip, err := d.destination(ctx, src, req.To, req.Conflict)
+	if err != nil || skip {
+		return &CopyResponse{Path: target, Skipped: skip}, err
+	}
+	if target == src || (info.IsDir() && within(src, target)) {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot copy %s onto or into itself", req.From)
+	}
+	if err = d.copyEntry(src, target, info); err != nil {
+		return nil, fileOpStatus(err)
+	}
+	return &CopyResponse{Path: target}, nil
+}
+
+func (d *defaultServer) Glob(ctx context.Context, req *GlobRequest) (*GlobResponse, error) {
+	logCall(ctx, "Glob")
+
+	cwd := sessionFromContext(ctx).Cwd()
+	pattern := req.Pattern
+	matches, err := d.glob(cwd, pattern)
+	if err != nil {
+		return nil, err
+	}
+	// hidden entries match only a pattern starting with '.' as in shells
+	hidden := strings.HasPrefix(filepath.Base(pattern), ".")
+	resp := &GlobResponse{}
+	for _, match := range matches {
+		if !hidden && strings.HasPrefix(filepath.Base(match), ".") {
+			continue
+		}
+		// matches out of the root or of it are left out, symlinks are followed as downloads do
+		real, err := d.root.resolve(cwd, match)
+		if err != nil || real == d.root.path {
+			continue
+		}
+		info, err := os.Stat(real)
+		if err != nil {
+			continue
+		}
+		// matches in the current directory are relative to it, others are absolute
+		name := match
+		if !filepath.IsAbs(req.Pattern) && match != cwd && within(cwd, match) {
+			if name, err = filepath.Rel(cwd, match); err != nil {
+				continue
+			}
+		}
+		m := &GlobMatch{Name: filepath.ToSlash(name), Type: fileType, Size: info.Size()}
+		if info.IsDir() {
+			// the size of a directory is unknown until its download lists it
+			m.Type, m.Size = dirType, 0
+		}
+		resp.Matches = append(resp.Matches, m)
+	}
+	return resp, nil
+}
+
+// glob returns the paths matching `pattern` relative to `cwd` as filepath.Glob, except that
+// every directory is resolved in the root before it is read, so no pattern lists a
+// directory out of the root. A pattern whose leading directory is out of the root fails.
+func (d *defaultServer) glob(cwd string, pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(cwd, pattern)
+	}
+	// the leading components without meta characters are one directory, the others are
+	// matched one by one
+	dir := filepath.Clean(pattern)
+	var components []string
+	for IsPattern(dir) {
+		components = append([]string{filepath.Base(dir)}, components...)
+		dir = filepath.Dir(dir)
+	}
+	if _, err := d.root.resolve(cwd, dir); err != nil {
+		return nil, err
+	}
+	matches := []string{dir}
+	for _, component := range components {
+		var next []string
+		for _, match := range matches {
+			if !IsPattern(component) {
+				next = append(next, filepath.Join(match, component))
+				continue
+			}
+			real, err := d.root.resolve(cwd, match)
+			if err != nil {
+				continue
+			}
+			entries, err := os.ReadDir(real)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if ok, _ := filepath.Match(component, entry.Name()); ok {
+					next = append(next, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+	return matches, nil
+}
+
+// destination returns the path `src` is moved or copied to as `to`, an existing directory
+// receives it under its name, and whether it is skipped under conflict policy `conflict`.
+// A symlink `to` is replaced itself as mv and cp do, unless written with a trailing slash.
+func (d *defaultServer) destination(ctx context.Context, src string, to string, conflict string) (string, bool, error) {
+	policy, err := ParseConflictPolicy(conflict)
+	if err != nil {
+		return "", false, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cwd := sessionFromContext(ctx).Cwd()
+	var target string
+	if strings.HasSuffix(to, "/") {
+		target, err = d.root.resolve(cwd, to)
+	} else if target, err = d.root.resolveEntry(cwd, to); err != nil {
+		// the root is no entry to replace, it receives `src` as any directory
+		if root, rootErr := d.root.resolve(cwd, to); rootErr == nil && root == d.root.path {
+			target, err = root, nil
+		}
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if info, err := os.Lstat(target); err == nil && info.IsDir() {
+		target = filepath.Join(target, filepath.Base(src))
+	}
+	if !d.root.contains(target) || target == d.root.path {
+		return "", false, status.Errorf(codes.PermissionDenied, "%s is out of the server root", to)
+	}
+	if target == src {
+		return target, false, nil
+	}
+	target, skip, err := resolveConflict(target, policy)
+	if _, ok := err.(errExists); ok {
+		return "", false, status.Error(codes.AlreadyExists, err.Error())
+	}
+	return target, skip, err
+}
+
+// copyEntry copies file or directory `src` of `info` to `dst`. A directory is copied next
+// to `dst` and moved in place once complete, merged with an existing directory `dst`.
+// Symlinks are copied as they are if they stay in the root.
+func (d *defaultServer) copyEntry(src string, dst string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return copyFile(src, dst, info)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dst), ".got-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmp := filepath.Join(tmpDir, filepath.Base(dst))
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmp, name)
+		switch {
+		case info.IsDir():
+			// directories stay writable for their content to be copied
+			return os.Mkdir(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err = pkg.CheckSymlink(d.root.path, filepath.Join(dst, name), filepath.ToSlash(name), link); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info)
+		}
+		// devices, pipes and sockets are not copied
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = os.Lstat(dst); err == nil {
+		return pkg.MergeDir(tmp, dst)
+	}
+	return os.Rename(tmp, dst)
+}
+
+// copyFile copies regular file `src` of `info` to `dst` atomically, with the same permission.
+func copyFile(src string, dst string, info os.FileInfo) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := pkg.CreateAtomic(dst, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer dstFile.Abort()
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	return dstFile.Commit()
+}
+
+// fileOpStatus maps the failure of a rename or copy to a gRPC status.
+func fileOpStatus(err error) error {
+	var untarErr *pkg.UnTarError
+	switch {
+	case errors.As(err, &untarErr):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, syscall.ENOTEMPTY), errors.Is(err, syscall.EEXIST),
+		errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.EISDIR):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return err
+}
+
+// Remove removes remote file or directory `name`, a directory must be empty unless `recursive`.
+func (d *defaultClient) Remove(name string, recursive bool) error {
+	var header metadata.MD
+	_, err := d.grpcClient.Remove(d.context(nil),
+		&RemoveRequest{Name: name, Recursive: recursive}, grpc.Header(&header))
+	if err != nil {
+		return err
+	}
+	return d.updateSession(header)
+}
+
+// MakeDir creates remote directory `name`, with its missing parents if `parents`.
+func (d *defaultClient) MakeDir(name string, parents bool) error {
+	var header metadata.MD
+	_, err := d.grpcClient.MakeDir(d.context(nil),
+		&MakeDirRequest{Name: name, Parents: parents}, grpc.Header(&header))
+	if err != nil {
+		return err
+	}
+	return d.updateSession(header)
+}
+
+// Rename moves remote file or directory `from` to `to`, into `to` if it is a directory.
+// `conflict` applies if the destination exists.
+func (d *defaultClient) Rename(from string, to string, conflict ConflictPolicy) (TransferResult, error) {
+	var header metadata.MD
+	resp, err := d.grpcClient.Rename(d.context(nil),
+		&RenameRequest{From: from, To: to, Conflict: string(conflict)}, grpc.Header(&header))
+	if err != nil {
+		return TransferResult{}, err
+	}
+	return TransferResult{Path: resp.Path, Skipped: resp.Skipped}, d.updateSession(header)
+}
+
+// Copy copies remote file or directory `from` to `to` on the server, into `to` if it is a
+// directory. A directory is copied only if `recursive`, `conflict` applies if the
+// destination exists.
+func (d *defaultClient) Copy(from string, to string, recursive bool, conflict ConflictPolicy) (TransferResult, error) {
+	var header metadata.MD
+	resp, err := d.grpcClient.Copy(d.context(nil),
+		&CopyRequest{From: from, To: to, Conflict: string(conflict), Recursive: recursive}, grpc.Header(&header))
+	if err != nil {
+		return TransferResult{}, err
+	}
+	return TransferResult{Path: resp.Path, Skipped: resp.Skipped}, d.updateSession(header)
+}
+
+// Glob returns the remote files and directories matching `pattern`, with the bytes the
+// download of each transfers.
+func (d *defaultClient) Glob(pattern string) ([]*GlobMatch, error) {
+	var header metadata.MD
+	resp, err := d.grpcClient.Glob(d.context(nil), &GlobRequest{Pattern: pattern}, grpc.Header(&header))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Matches, d.updateSession(header)
+}
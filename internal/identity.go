@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"log"
+)
+
+const anonymous = "anonymous"
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of `ctx` carrying the caller identity.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the caller identity of a request,
+// `anonymous` if the caller is not authenticated.
+func IdentityFromContext(ctx context.Context) string {
+	if identity, ok := ctx.Value(identityKey{}).(string); ok && identity != "" {
+		return identity
+	}
+	return anonymous
+}
+
+// peerIdentity extracts the identity from the verified client certificate of the peer.
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return certIdentity(tlsInfo.State.VerifiedChains[0][0])
+}
+
+// contextStream overrides the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (c *contextStream) Context() context.Context {
+	return c.ctx
+}
+
+// logCall logs the called method with the caller's address and identity.
+func logCall(ctx context.Context, method string) {
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	log.Printf("%-12s called from: %s (%s)\n", method, addr, IdentityFromContext(ctx))
+}
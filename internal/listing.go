@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NewFileEntry returns the listing entry of file `info` of directory `dir`.
+func NewFileEntry(dir string, info os.FileInfo) *FileEntry {
+	entry := &FileEntry{
+		Name:  info.Name(),
+		Type:  fileType,
+		Size:  info.Size(),
+		Mode:  uint32(info.Mode()),
+		Mtime: info.ModTime().UnixNano(),
+		Owner: fileOwner(info),
+	}
+	switch {
+	case info.IsDir():
+		entry.Type = dirType
+	case info.Mode()&os.ModeSymlink != 0:
+		entry.Type = symlinkType
+		// an unreadable target is listed empty
+		entry.Link, _ = os.Readlink(filepath.Join(dir, info.Name()))
+	}
+	return entry
+}
+
+// IsDir reports whether the entry is a directory, a symlink to a directory is not.
+func (e *FileEntry) IsDir() bool {
+	return e.Type == dirType
+}
+
+// FileMode returns the mode of the entry.
+func (e *FileEntry) FileMode() os.FileMode {
+	return os.FileMode(e.Mode)
+}
+
+// ModTime returns the modification time of the entry.
+func (e *FileEntry) ModTime() time.Time {
+	return time.Unix(0, e.Mtime)
+}
@@ -0,0 +1,563 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"got/pkg"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const symlinkType = "symlink"
+
+// DefaultWorkers is the count of concurrent streams the files of a directory are transferred over.
+const DefaultWorkers = 4
+
+// buildManifest lists the entries of directory `dir`, every directory before its content.
+// Devices, FIFOs and sockets are left out.
+func buildManifest(dir string) ([]*ManifestEntry, error) {
+	var entries []*ManifestEntry
+	err := filepath.Walk(dir, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		entry := &ManifestEntry{
+			Path:  filepath.ToSlash(rel),
+			Mode:  uint32(info.Mode().Perm()),
+			Mtime: info.ModTime().UnixNano(),
+		}
+		switch {
+		case info.IsDir():
+			entry.Type = dirType
+		case info.Mode().IsRegular():
+			entry.Type = fileType
+			entry.Size = info.Size()
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Type = symlinkType
+			if entry.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// applyManifest creates the directories and symlinks of `entries` in directory `dst` and
+// returns the files which are missing or changed. Entries are checked as tar entries by
+// pkg.UnTarFrom and must be within `limits`, rejections are reported as *pkg.UnTarError.
+// No entry is applied unless all pass checkManifest.
+func applyManifest(dst string, entries []*ManifestEntry, limits pkg.UnTarLimits) ([]*ManifestEntry, error) {
+	if err := checkManifest(dst, entries, limits); err != nil {
+		return nil, err
+	}
+	var needed []*ManifestEntry
+	for _, entry := range entries {
+		p, err := pkg.EntryPath(dst, entry.Path, limits.MaxDepth)
+		if err != nil {
+			return nil, err
+		}
+
+		switch entry.Type {
+		case dirType:
+			if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return nil, &pkg.UnTarError{Name: entry.Path, Err: fmt.Errorf("%w: directory is a symlink",
+					pkg.ErrUnsafeEntry)}
+			}
+			if err = os.MkdirAll(p, os.ModeDir|0755); err != nil {
+				return nil, err
+			}
+		case fileType:
+			if err = os.MkdirAll(filepath.Dir(p), os.ModeDir|0755); err != nil {
+				return nil, err
+			}
+			if !unchanged(p, entry) {
+				needed = append(needed, entry)
+			}
+		case symlinkType:
+			if err = pkg.CheckSymlink(dst, p, entry.Path, entry.Link); err != nil {
+				return nil, err
+			}
+			if link, err := os.Readlink(p); err == nil && link == entry.Link {
+				continue
+			}
+			_ = os.MkdirAll(filepath.Dir(p), os.ModeDir|0755)
+			_ = os.Remove(p)
+			if err = os.Symlink(entry.Link, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return needed, nil
+}
+
+// checkManifest rejects `entries` for directory `dst` beyond `limits`, or unsafe by their
+// paths, types and symlink targets alone, before anything in `dst` is changed for them.
+// The files in `dst` are looked at once the entries are applied.
+func checkManifest(dst string, entries []*ManifestEntry, limits pkg.UnTarLimits) error {
+	if limits.MaxEntries > 0 && len(entries) > limits.MaxEntries {
+		return &pkg.UnTarError{Name: dst, Err: fmt.Errorf("%w: more than %d entries",
+			pkg.ErrLimitExceeded, limits.MaxEntries)}
+	}
+	var totalBytes int64
+	for _, entry := range entries {
+		if entry.Size < 0 {
+			return &pkg.UnTarError{Name: entry.Path, Err: fmt.Errorf("%w: negative size", pkg.ErrUnsafeEntry)}
+		}
+		totalBytes += entry.Size
+		if limits.MaxBytes > 0 && totalBytes > limits.MaxBytes {
+			return &pkg.UnTarError{Name: entry.Path, Err: fmt.Errorf("%w: more than %d bytes",
+				pkg.ErrLimitExceeded, limits.MaxBytes)}
+		}
+		p, err := pkg.CleanEntryPath(dst, entry.Path, limits.MaxDepth)
+		if err != nil {
+			return err
+		}
+		if p == dst {
+			return &pkg.UnTarError{Name: entry.Path, Err: fmt.Errorf("%w: empty path", pkg.ErrUnsafeEntry)}
+		}
+		switch entry.Type {
+		case dirType, fileType:
+		case symlinkType:
+			if err = pkg.CheckSymlinkTarget(dst, p, entry.Path, entry.Link); err != nil {
+				return err
+			}
+		default:
+			return &pkg.UnTarError{Name: entry.Path, Err: fmt.Errorf("%w: type %q not allowed",
+				pkg.ErrUnsafeEntry, entry.Type)}
+		}
+	}
+	return nil
+}
+
+// unchanged reports whether the file at `p` matches `entry` by size and modification time.
+// Times without fraction of a second on either side, as kept by coarse filesystems, are
+// compared in seconds.
+func unchanged(p string, entry *ManifestEntry) bool {
+	info, err := os.Lstat(p)
+	return err == nil && info.Mode().IsRegular() && info.Size() == entry.Size &&
+		sameMtime(info.ModTime().UnixNano(), entry.Mtime)
+}
+
+// sameMtime reports whether modification times `a` and `b` in unix nanoseconds are equal.
+func sameMtime(a int64, b int64) bool {
+	ta, tb := time.Unix(0, a), time.Unix(0, b)
+	if ta.Nanosecond() == 0 || tb.Nanosecond() == 0 {
+		return ta.Unix() == tb.Unix()
+	}
+	return ta.Equal(tb)
+}
+
+// checksumManifest sets the checksums of `algorithm` of the files of `entries` in `dir`.
+func checksumManifest(dir string, entries []*ManifestEntry, algorithm string) error {
+	for _, entry := range entries {
+		if entry.Type != fileType {
+			continue
+		}
+		checksum, err := pkg.NewChecksum(algorithm)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(checksum, file)
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+		entry.Checksum = checksum.String()
+	}
+	return nil
+}
+
+// countFiles returns the count of regular files in `entries`.
+func countFiles(entries []*ManifestEntry) int {
+	var n int
+	for _, entry := range entries {
+		if entry.Type == fileType {
+			n++
+		}
+	}
+	return n
+}
+
+// setAttributes sets the permission bits and modification time of a received file,
+// zero values are left as they are.
+func setAttributes(p string, mode os.FileMode, mtime int64) error {
+	if mode != 0 {
+		if err := os.Chmod(p, mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if mtime != 0 {
+		t := time.Unix(0, mtime)
+		return os.Chtimes(p, t, t)
+	}
+	return nil
+}
+
+func (d *defaultServer) UploadManifest(ctx context.Context, req *UploadManifestRequest) (*UploadManifestResponse, error) {
+	logCall(ctx, "UploadManifest")
+
+	policy, err := ParseConflictPolicy(req.Conflict)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	dir, err := d.resolve(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	target, skip, err := resolveConflict(dir, policy)
+	if _, ok := err.(errExists); ok {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	if skip {
+		return &UploadManifestResponse{Name: req.Name, Path: target, Skipped: true}, nil
+	}
+
+	// an existing directory is merged, only its missing or changed files are requested
+	if err = os.Mkdir(target, os.ModeDir|0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if info, err := os.Stat(target); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is not a directory", target)
+	}
+	needed, err := applyManifest(target, req.Entries, d.config.UnTarLimits)
+	if err != nil {
+		return nil, untarStatus(err)
+	}
+
+	// the files are uploaded by the name of the directory relative to the current directory
+	resp := &UploadManifestResponse{Name: req.Name, Path: target}
+	if target != dir {
+		resp.Name = filepath.Join(filepath.Dir(req.Name), filepath.Base(target))
+	}
+	for _, entry := range needed {
+		resp.Needed = append(resp.Needed, entry.Path)
+	}
+	return resp, nil
+}
+
+func (d *defaultServer) DownloadManifest(ctx context.Context, req *DownloadManifestRequest) (*DownloadManifestResponse, error) {
+	logCall(ctx, "DownloadManifest")
+
+	dir, err := d.resolve(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", req.Name)
+	} else if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is not a directory", req.Name)
+	}
+	entries, err := buildManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if req.ChecksumAlgorithm != "" {
+		if err = checksumManifest(dir, entries, req.ChecksumAlgorithm); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return &DownloadManifestResponse{Entries: entries}, nil
+}
+
+// uploadDir uploads directory `dirPath` as remote path `name` file by file: the server
+// creates the directories of its manifest and answers with the files it misses, which are
+// then uploaded over options.Workers concurrent streams. A server without manifests is
+// sent a tar stream.
+func (d *defaultClient) uploadDir(dirPath string, name string, options TransferOptions) (TransferResult, error) {
+	root, err := filepath.EvalSymlinks(dirPath)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	entries, err := buildManifest(root)
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	var header metadata.MD
+	resp, err := d.grpcClient.UploadManifest(d.context(nil), &UploadManifestRequest{
+		Name:     name,
+		Conflict: string(options.Conflict),
+		Entries:  entries,
+	}, grpc.Header(&header))
+	if status.Code(err) == codes.Unimplemented {
+		options.Tar = true
+		return d.uploadFile(dirPath, name, options)
+	} else if err != nil {
+		return TransferResult{}, err
+	}
+	if err = d.updateSession(header); err != nil {
+		return TransferResult{}, err
+	}
+	if resp.Skipped {
+		return TransferResult{Path: resp.Path, Skipped: true}, nil
+	}
+
+	byPath := make(map[string]*ManifestEntry, len(entries))
+	for _, entry := range entries {
+		byPath[entry.Path] = entry
+	}
+	var files []*ManifestEntry
+	for _, p := range resp.Needed {
+		entry, ok := byPath[p]
+		if !ok || entry.Type != fileType {
+			return TransferResult{}, fmt.Errorf("server requested unknown file %q", p)
+		}
+		files = append(files, entry)
+	}
+
+	result := TransferResult{Path: resp.Path, Unchanged: countFiles(entries) - len(files)}
+	remote := filepath.ToSlash(resp.Name)
+	err = d.transferFiles("upload", files, options, &result,
+		func(ctx context.Context, entry *ManifestEntry, push chan<- int64) (int64, error) {
+			return d.uploadEntry(ctx, filepath.Join(root, filepath.FromSlash(entry.Path)),
+				path.Join(remote, entry.Path), entry, options.Delta, push)
+		})
+	return result, err
+}
+
+// uploadEntry uploads file `localPath` of a directory as `name`, by its delta to the copy
+// on the server if `delta` is set. The server overwrites it and sets the mode and
+// modification time of `entry`.
+func (d *defaultClient) uploadEntry(ctx context.Context, localPath string, name string, entry *ManifestEntry,
+	delta bool, push chan<- int64) (int64, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var mdMap = map[string]string{
+		"name":      name,
+		"type":      fileType,
+		"mode":      strconv.FormatUint(uint64(entry.Mode), 10),
+		"mtime":     strconv.FormatInt(entry.Mtime, 10),
+		conflictKey: string(ConflictOverwrite),
+	}
+	if accept := d.acceptCompression(name, false); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return 0, err
+	}
+	var signature *pkg.Signature
+	if delta {
+		if signature, err = d.fileSignature(ctx, name); err != nil && err != errNoBase {
+			return 0, err
+		}
+	}
+	var resp *UploadFileResponse
+	var sent int64
+	if signature != nil {
+		resp, _, sent, err = d.sendDelta(ctx, signature, file, mdMap, checksum, push)
+	} else {
+		var stream GotService_UploadFileClient
+		if stream, err = d.grpcClient.UploadFile(d.outgoingContext(ctx, mdMap)); err != nil {
+			return 0, err
+		}
+		reader := io.TeeReader(file, io.MultiWriter(checksum, progressWriter{push: push}))
+		resp, _, sent, err = d.sendUpload(stream, reader, checksum)
+	}
+	if err != nil {
+		return sent, err
+	}
+	if resp.Checksum != checksum.String() {
+		return sent, fmt.Errorf("checksum mismatch: expect %q, got %q", checksum, resp.Checksum)
+	}
+	return sent, nil
+}
+
+// downloadDir downloads directory `filePath` described by `entries` to local path `target`
+// file by file: the directories are created first, then the missing or changed files are
+// downloaded over options.Workers concurrent streams.
+func (d *defaultClient) downloadDir(filePath string, target string, entries []*ManifestEntry,
+	options TransferOptions) (TransferResult, error) {
+	// apply the conflict policy
+	target, skip, err := resolveConflict(target, options.Conflict)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if skip {
+		return TransferResult{Path: target, Skipped: true}, nil
+	}
+	if err = os.Mkdir(target, os.ModeDir|0755); err != nil && !os.IsExist(err) {
+		return TransferResult{}, err
+	}
+	if info, err := os.Stat(target); err != nil {
+		return TransferResult{}, err
+	} else if !info.IsDir() {
+		return TransferResult{}, fmt.Errorf("%s is not a directory", target)
+	}
+	files, err := applyManifest(target, entries, pkg.DefaultUnTarLimits)
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	result := TransferResult{Path: target, Unchanged: countFiles(entries) - len(files)}
+	err = d.downloadEntries(filepath.ToSlash(filePath), target, files, options, &result)
+	return result, err
+}
+
+// downloadEntries downloads `files` of remote directory `remote` into local directory `dst`
+// by transferFiles. The path of every file is checked again when it is downloaded, a
+// symlink may have replaced a directory of it since the manifest was applied.
+func (d *defaultClient) downloadEntries(remote string, dst string, files []*ManifestEntry,
+	options TransferOptions, result *TransferResult) error {
+	return d.transferFiles("download", files, options, result,
+		func(ctx context.Context, entry *ManifestEntry, push chan<- int64) (int64, error) {
+			p, err := pkg.EntryPath(dst, entry.Path, pkg.DefaultUnTarLimits.MaxDepth)
+			if err != nil {
+				return 0, err
+			}
+			return d.downloadEntry(ctx, path.Join(remote, entry.Path), p, entry, options.Delta, push)
+		})
+}
+
+// downloadEntry downloads file `name` of a directory into `localPath`, by its delta to
+// the existing local file if `delta` is set, and sets the mode and modification time
+// of `entry`.
+func (d *defaultClient) downloadEntry(ctx context.Context, name string, localPath string, entry *ManifestEntry,
+	delta bool, push chan<- int64) (int64, error) {
+	file, err := pkg.CreateAtomic(localPath, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Abort()
+	w := io.MultiWriter(file, progressWriter{push: push})
+	check := func(md metadata.MD) error {
+		if t := md.Get("type"); t == nil || t[0] != fileType {
+			return fmt.Errorf("%s is not a file", name)
+		}
+		return nil
+	}
+
+	var written int64
+	err = errNoBase
+	if delta {
+		if base, info, baseErr := openBase(localPath); baseErr == nil {
+			checksum, _ := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+			written, err = d.readDelta(ctx, name, base, info.Size(), w, checksum, check)
+			_ = base.Close()
+		}
+	}
+	if err == errNoBase {
+		written, _, err = d.readRange(ctx, name, 0, 0, w, check)
+	}
+	if err != nil {
+		return written, err
+	}
+	if err = file.Commit(); err != nil {
+		return written, err
+	}
+	return written, setAttributes(localPath, os.FileMode(entry.Mode), entry.Mtime)
+}
+
+// transferFiles transfers `files` of a directory by `transfer` over options.Workers
+// concurrent workers, with one progress bar for all of them. Transferred and failed
+// files are recorded in `result`, the first failure stops the transfer unless
+// options.ContinueOnError is set.
+func (d *defaultClient) transferFiles(tag string, files []*ManifestEntry, options TransferOptions,
+	result *TransferResult, transfer func(ctx context.Context, entry *ManifestEntry, push chan<- int64) (int64, error)) error {
+	var total int64
+	for _, entry := range files {
+		total += entry.Size
+	}
+
+	// prepare process bar
+	var pushCh = make(chan int64, 2)
+	var procCtx, cancel = context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		close(pushCh)
+	}()
+	procBar := processBar(tag, 0, total, pushCh, procCtx, options)
+
+	workers := options.Workers
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	queue := make(chan *ManifestEntry)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var transferred int64
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range queue {
+				n, err := transfer(ctx, entry, pushCh)
+				mu.Lock()
+				transferred += n
+				switch {
+				case err == nil:
+					result.Files++
+				case ctx.Err() == nil:
+					// failures of files cancelled by a stop are not recorded
+					result.Failed = append(result.Failed, FileError{Path: entry.Path, Err: err})
+					if !options.ContinueOnError {
+						stop()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, entry := range files {
+		select {
+		case queue <- entry:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if transferred < total {
+		// files failed or shrank while being sent, the bar would never finish
+		cancel()
+	}
+	<-procBar
+
+	switch {
+	case len(result.Failed) == 0:
+		return nil
+	case !options.ContinueOnError:
+		return fmt.Errorf("%s stopped after %s failed", tag, result.Failed[0].Path)
+	}
+	return fmt.Errorf("%d of %d files failed", len(result.Failed), len(files))
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"errors"
+	"got/pkg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyManifest(t *testing.T) {
+	dst := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dst, "same"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []*ManifestEntry{
+		{Path: "d/e", Type: dirType},
+		{Path: "d/l", Type: symlinkType, Link: "e"},
+		{Path: "same", Type: fileType, Size: info.Size(), Mtime: info.ModTime().UnixNano()},
+		{Path: "d/new", Type: fileType, Size: 1},
+	}
+	needed, err := applyManifest(dst, entries, pkg.DefaultUnTarLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(needed) != 1 || needed[0].Path != "d/new" {
+		t.Fatalf("needed %v, want d/new", needed)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "d", "l")); err != nil || link != "e" {
+		t.Fatalf("symlink d/l = %q, %v", link, err)
+	}
+}
+
+// TestApplyManifestRejects checks that a rejected manifest changes nothing, even by the
+// entries before the rejected one.
+func TestApplyManifestRejects(t *testing.T) {
+	limits := pkg.UnTarLimits{MaxBytes: 10, MaxEntries: 3, MaxDepth: 3}
+	tests := []struct {
+		name  string
+		entry *ManifestEntry
+		err   error
+	}{
+		{name: "dot dot", entry: &ManifestEntry{Path: "../x", Type: fileType}, err: pkg.ErrUnsafeEntry},
+		{name: "absolute", entry: &ManifestEntry{Path: "/x", Type: dirType}, err: pkg.ErrUnsafeEntry},
+		{name: "empty", entry: &ManifestEntry{Path: ".", Type: dirType}, err: pkg.ErrUnsafeEntry},
+		{name: "symlink out", entry: &ManifestEntry{Path: "l", Type: symlinkType, Link: "../x"}, err: pkg.ErrUnsafeEntry},
+		{name: "symlink absolute", entry: &ManifestEntry{Path: "l", Type: symlinkType, Link: "/etc"}, err: pkg.ErrUnsafeEntry},
+		{name: "unknown type", entry: &ManifestEntry{Path: "x", Type: "device"}, err: pkg.ErrUnsafeEntry},
+		{name: "negative size", entry: &ManifestEntry{Path: "x", Type: fileType, Size: -1}, err: pkg.ErrUnsafeEntry},
+		{name: "too large", entry: &ManifestEntry{Path: "x", Type: fileType, Size: 11}, err: pkg.ErrLimitExceeded},
+		{name: "too deep", entry: &ManifestEntry{Path: "a/b/c/d", Type: dirType}, err: pkg.ErrLimitExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := t.TempDir()
+			entries := []*ManifestEntry{{Path: "first", Type: dirType}, test.entry}
+			_, err := applyManifest(dst, entries, limits)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("applyManifest = %v, want %v", err, test.err)
+			}
+			if _, err = os.Lstat(filepath.Join(dst, "first")); !os.IsNotExist(err) {
+				t.Fatalf("first entry applied: %v", err)
+			}
+		})
+	}
+
+	entries := []*ManifestEntry{{Path: "a", Type: dirType}, {Path: "b", Type: dirType},
+		{Path: "c", Type: dirType}, {Path: "d", Type: dirType}}
+	if _, err := applyManifest(t.TempDir(), entries, limits); !errors.Is(err, pkg.ErrLimitExceeded) {
+		t.Fatalf("applyManifest of %d entries = %v, want %v", len(entries), err, pkg.ErrLimitExceeded)
+	}
+}
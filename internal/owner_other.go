@@ -0,0 +1,12 @@
+//go:build !unix
+
+package internal
+
+import (
+	"os"
+)
+
+// owners of files are not listed where they are not uids
+func fileOwner(info os.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"got/pkg"
+	"io"
+	"os"
+	"strconv"
+)
+
+const parallelKey = "parallel"
+const lengthKey = "length"
+
+const (
+	// parallelPart uploads the range `offset`, `length` of a parallel upload
+	parallelPart = "part"
+	// parallelCommit verifies the parts of a parallel upload and moves them in place
+	parallelCommit = "commit"
+)
+
+// minPartSize is the smallest range of a parallel transfer, smaller files use fewer streams.
+const minPartSize = 1 << 20
+
+func parseParallel(s string, transferID string) (string, error) {
+	if s != parallelPart && s != parallelCommit {
+		return "", status.Errorf(codes.InvalidArgument, "unknown parallel mode %q", s)
+	}
+	if transferID == "" {
+		return "", status.Error(codes.InvalidArgument, "parallel upload requires a transfer ID")
+	}
+	return s, nil
+}
+
+// metadataInt returns the non-negative integer of `key` in `md`, 0 if absent.
+func metadataInt(md metadata.MD, key string) (int64, error) {
+	v := md.Get(key)
+	if v == nil {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil || n < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s %q", key, v[0])
+	}
+	return n, nil
+}
+
+// partWriter writes a part of a parallel upload, it rejects data beyond the part.
+type partWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > p.remaining {
+		return 0, status.Error(codes.InvalidArgument, "data beyond the part")
+	}
+	n, err := p.w.Write(b)
+	p.remaining -= int64(n)
+	return n, err
+}
+
+// offsetWriter writes to `w` from `offset` on.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.WriteAt(b, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// progressWriter reports the size of written data to `push`.
+type progressWriter struct {
+	push chan<- int64
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	p.push <- int64(len(b))
+	return len(b), nil
+}
+
+// partRanges splits `size` bytes into at most `n` ranges of at least minPartSize,
+// each range is an offset and a length.
+func partRanges(size int64, n int) [][2]int64 {
+	if max := size / minPartSize; int64(n) > max {
+		n = int(max)
+	}
+	if n < 1 {
+		n = 1
+	}
+	var ranges [][2]int64
+	partSize := (size + int64(n) - 1) / int64(n)
+	for offset := int64(0); offset < size; offset += partSize {
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		ranges = append(ranges, [2]int64{offset, length})
+	}
+	return ranges
+}
+
+// commitParallel verifies the staging file of a parallel upload against the checksum
+// of the whole file and moves it to `target`.
+func (d *defaultServer) commitParallel(stream GotService_UploadFileServer, transferID string, size int64,
+	algorithm string, target string) error {
+	var expected string
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if req.Checksum != "" {
+			expected = req.Checksum
+		}
+	}
+
+	path := d.staging.path(stream.Context(), transferID)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return status.Error(codes.FailedPrecondition, "no parts uploaded")
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return status.Errorf(codes.FailedPrecondition, "%d bytes staged, expect %d", info.Size(), size)
+	}
+	checksum, err := pkg.NewChecksum(algorithm)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = io.Copy(checksum, file); err != nil {
+		return err
+	}
+	_ = file.Close()
+	if expected != checksum.String() {
+		_ = os.Remove(path)
+		return status.Errorf(codes.DataLoss, "checksum mismatch: expect %q, got %q", expected, checksum)
+	}
+	if err = pkg.MoveFile(path, target, 0664); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&UploadFileResponse{Ok: true, Checksum: checksum.String(), Path: target})
+}
+
+// uploadParallel uploads file `filePath` in ranges over concurrent streams. The server
+// writes the ranges into one staging file, which is verified against the checksum of
+// the whole file and moved in place by a final commit.
+func (d *defaultClient) uploadParallel(filePath string, name string, info os.FileInfo,
+	options TransferOptions) (TransferResult, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	defer file.Close()
+
+	size := info.Size()
+	transferID, err := d.transferID(filePath, name, info, size)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	var mdMap = map[string]string{
+		"name":        name,
+		"type":        fileType,
+		"size":        strconv.FormatInt(size, 10),
+		transferIDKey: parallelKey + "-" + transferID,
+		parallelKey:   parallelPart,
+	}
+	if options.Conflict != "" {
+		mdMap[conflictKey] = string(options.Conflict)
+	}
+	if accept := d.acceptCompression(filePath, false); accept != "" {
+		mdMap[acceptCompressionKey] = accept
+	}
+
+	// the checksum of the whole file is computed while the parts are sent
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	checksumDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(checksum, io.NewSectionReader(file, 0, size))
+		checksumDone <- err
+	}()
+
+	// prepare process bar
+	var pushCh = make(chan int64, 2)
+	var procCtx, cancel = context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		close(pushCh)
+	}()
+	procBar := processBar("upload", 0, size, pushCh, procCtx, options)
+
+	// the first failed part cancels the others
+	ctx, cancelParts := context.WithCancel(context.Background())
+	defer cancelParts()
+	ranges := partRanges(size, options.Parallel)
+	results := make(chan partResult, len(ranges))
+	for _, r := range ranges {
+		go func(offset, length int64) {
+			resp, err := d.uploadPart(ctx, mdMap, io.NewSectionReader(file, offset, length), offset, length, pushCh)
+			results <- partResult{resp: resp, err: err}
+		}(r[0], r[1])
+	}
+	var failed error
+	var skipped *UploadFileResponse
+	for range ranges {
+		result := <-results
+		if result.err != nil && failed == nil {
+			failed = result.err
+			cancelParts()
+		} else if result.resp != nil && result.resp.Skipped && skipped == nil {
+			skipped = result.resp
+			cancelParts()
+		}
+	}
+	// the checksum is abandoned otherwise, closing the file ends it
+	switch {
+	case skipped != nil:
+		cancel()
+		return TransferResult{Path: skipped.Path, Skipped: true}, nil
+	case failed != nil:
+		cancel()
+		return TransferResult{}, failed
+	}
+	<-procBar
+	if err = <-checksumDone; err != nil {
+		return TransferResult{}, err
+	}
+
+	// all parts are staged, commit them with the checksum of the whole file
+	mdMap[parallelKey] = parallelCommit
+	stream, err := d.grpcClient.UploadFile(d.context(mdMap))
+	if err != nil {
+		return TransferResult{}, err
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if err = stream.Send(&UploadFileRequest{Checksum: checksum.String()}); err != nil && err != io.EOF {
+		return TransferResult{}, err
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if err = d.updateSession(header); err != nil {
+		return TransferResult{}, err
+	}
+	if resp.Skipped {
+		return TransferResult{Path: resp.Path, Skipped: true}, nil
+	}
+	if resp.Checksum != checksum.String() {
+		return TransferResult{}, fmt.Errorf("checksum mismatch: expect %q, got %q", checksum, resp.Checksum)
+	}
+	return TransferResult{Path: resp.Path, Checksum: checksum.String()}, nil
+}
+
+type partResult struct {
+	resp *UploadFileResponse
+	err  error
+}
+
+// uploadPart uploads the range of a parallel upload read from `reader`.
+func (d *defaultClient) uploadPart(ctx context.Context, mdMap map[string]string, reader io.Reader,
+	offset int64, length int64, push chan<- int64) (*UploadFileResponse, error) {
+	var partMap = map[string]string{
+		offsetKey: strconv.FormatInt(offset, 10),
+		lengthKey: strconv.FormatInt(length, 10),
+	}
+	for k, v := range mdMap {
+		partMap[k] = v
+	}
+	stream, err := d.grpcClient.UploadFile(d.outgoingContext(ctx, partMap))
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	reader = io.TeeReader(reader, io.MultiWriter(checksum, progressWriter{push: push}))
+	resp, _, _, err := d.sendUpload(stream, reader, checksum)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Skipped && resp.Checksum != checksum.String() {
+		return nil, fmt.Errorf("checksum mismatch of part at %d: expect %q, got %q", offset, checksum, resp.Checksum)
+	}
+	return resp, nil
+}
+
+// downloadParallel downloads file `filePath` in ranges over concurrent streams, written at
+// their offsets into the temporary file of the destination. Every range is verified by
+// its own checksum while received, and again in the file once all are written.
+func (d *defaultClient) downloadParallel(filePath string, target string, options TransferOptions) (TransferResult, error) {
+	// the type, size and version of the file come with the header of its first byte
+	var size, mtime int64
+	var downloadType string
+	probe, cancelProbe := context.WithCancel(context.Background())
+	_, _, err := d.readRange(probe, filePath, 0, 1, io.Discard, func(md metadata.MD) error {
+		if t := md.Get("type"); t != nil {
+			downloadType = t[0]
+		}
+		size, _ = metadataInt(md, "size")
+		mtime, _ = metadataInt(md, "mtime")
+		return errProbed
+	})
+	cancelProbe()
+	if err != errProbed {
+		return TransferResult{}, err
+	}
+	ranges := partRanges(size, options.Parallel)
+	if downloadType != fileType || len(ranges) < 2 {
+		options.Parallel = 0
+		return d.downloadFile(filePath, target, options)
+	}
+
+	// apply the conflict policy
+	target, skip, err := resolveConflict(target, options.Conflict)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if skip {
+		return TransferResult{Path: target, Skipped: true}, nil
+	}
+	file, err := pkg.CreateAtomic(target, 0666)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	defer file.Abort()
+	if err = file.Truncate(size); err != nil {
+		return TransferResult{}, err
+	}
+
+	// prepare process bar
+	var pushCh = make(chan int64, 2)
+	var procCtx, cancel = context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		close(pushCh)
+	}()
+	procBar := processBar("download", 0, size, pushCh, procCtx, options)
+
+	// the first failed range cancels the others, every range must be of the same version.
+	// the checksum the server sent for each range is kept for verifying the file
+	ctx, cancelParts := context.WithCancel(context.Background())
+	defer cancelParts()
+	expected := make([]string, len(ranges))
+	errs := make(chan error, len(ranges))
+	for i, r := range ranges {
+		go func(i int, offset, length int64) {
+			w := io.MultiWriter(&offsetWriter{w: file.File, offset: offset}, progressWriter{push: pushCh})
+			var err error
+			_, expected[i], err = d.readRange(ctx, filePath, offset, length, w, func(md metadata.MD) error {
+				s, _ := metadataInt(md, "size")
+				m, _ := metadataInt(md, "mtime")
+				if s != size || m != mtime {
+					return fmt.Errorf("%s changed during the download", filePath)
+				}
+				return nil
+			})
+			errs <- err
+		}(i, r[0], r[1])
+	}
+	var failed error
+	for range ranges {
+		if err := <-errs; err != nil && failed == nil {
+			failed = err
+			cancelParts()
+		}
+	}
+	if failed != nil {
+		cancel()
+		return TransferResult{}, failed
+	}
+	<-procBar
+
+	// the ranges are read back from the file they are merged into, each must match the
+	// checksum of the server, and together they make the checksum of the whole file
+	checksum, err := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	for i, r := range ranges {
+		rangeChecksum, _ := pkg.NewChecksum(d.config.ChecksumAlgorithm)
+		section := io.NewSectionReader(file.File, r[0], r[1])
+		if _, err = io.Copy(io.MultiWriter(checksum, rangeChecksum), section); err != nil {
+			return TransferResult{}, err
+		}
+		if expected[i] != rangeChecksum.String() {
+			return TransferResult{}, fmt.Errorf("checksum mismatch of range at %d: expect %q, got %q",
+				r[0], expected[i], rangeChecksum)
+		}
+	}
+	if err = file.Commit(); err != nil {
+		return TransferResult{}, err
+	}
+	return TransferResult{Path: target, Checksum: checksum.String()}, nil
+}
+
+// errProbed ends the probe of a parallel download once its header is checked.
+var errProbed = errors.New("probed")
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rootDir confines every path the server touches to the root directory.
+type rootDir struct {
+	path string
+}
+
+func newRootDir(path string) (*rootDir, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("root is not a directory: " + path)
+	}
+	return &rootDir{path: path}, nil
+}
+
+// resolve returns the real path of `p` relative to `base`, with all symlinks evaluated.
+// The last components of `p` may not exist yet. A path resolved out of the root fails
+// with `codes.PermissionDenied`.
+func (r *rootDir) resolve(base string, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+	p = filepath.Clean(p)
+
+	// evaluate symlinks of the longest existing prefix
+	var rest []string
+	real := p
+	for {
+		resolved, err := filepath.EvalSymlinks(real)
+		if err == nil {
+			real = resolved
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(real)
+		if parent == real {
+			break
+		}
+		rest = append([]string{filepath.Base(real)}, rest...)
+		real = parent
+	}
+	real = filepath.Join(append([]string{real}, rest...)...)
+
+	if !r.contains(real) {
+		return "", status.Errorf(codes.PermissionDenied, "%s is out of the server root", p)
+	}
+	return real, nil
+}
+
+func (r *rootDir) contains(p string) bool {
+	return within(r.path, p)
+}
+
+// within reports whether `p` is `dir` or inside `dir`.
+func within(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// resolveEntry returns the path of `p` relative to `base` as resolve, except that a symlink
+// at the last component is not evaluated, so the symlink itself is addressed. The root
+// itself cannot be addressed.
+func (r *rootDir) resolveEntry(base string, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+	p = filepath.Clean(p)
+	parent, err := r.resolve(base, filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	real := filepath.Join(parent, filepath.Base(p))
+	if !r.contains(real) {
+		return "", status.Errorf(codes.PermissionDenied, "%s is out of the server root", p)
+	}
+	if real == r.path {
+		return "", status.Errorf(codes.PermissionDenied, "%s is the server root", p)
+	}
+	return real, nil
+}
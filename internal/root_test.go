@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRoot returns a root holding a/b, symlinks in -> a, out -> a directory out of the
+// root and a/up -> ../.., and the directory out of the root.
+func newTestRoot(t *testing.T) (*rootDir, string) {
+	t.Helper()
+	base := t.TempDir()
+	outside := filepath.Join(base, "outside")
+	rootPath := filepath.Join(base, "root")
+	for _, dir := range []string{outside, filepath.Join(rootPath, "a", "b")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(rootPath, "in"):      "a",
+		filepath.Join(rootPath, "out"):     outside,
+		filepath.Join(rootPath, "a", "up"): filepath.Join("..", ".."),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+	root, err := newRootDir(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err = filepath.EvalSymlinks(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func TestRootResolve(t *testing.T) {
+	root, outside := newTestRoot(t)
+	tests := []struct {
+		name string
+		base string
+		p    string
+		want string
+	}{
+		{name: "root", p: ".", want: "."},
+		{name: "empty", p: "", want: "."},
+		{name: "relative", p: "a/b", want: "a/b"},
+		{name: "relative to base", base: "a", p: "b", want: "a/b"},
+		{name: "dot dot inside", p: "a/b/..", want: "a"},
+		{name: "dot dot out", p: "../x"},
+		{name: "dot dot out of base", base: "a", p: "../../x"},
+		{name: "dot dot through a directory", p: "a/../../x"},
+		{name: "absolute inside", p: filepath.Join(root.path, "a"), want: "a"},
+		{name: "absolute root", p: root.path, want: "."},
+		{name: "absolute out", p: outside},
+		{name: "absolute system", p: "/etc"},
+		{name: "symlink inside", p: "in/b", want: "a/b"},
+		{name: "symlink out", p: "out"},
+		{name: "symlink out with missing tail", p: "out/missing/file"},
+		{name: "symlink up out", p: "a/up"},
+		{name: "missing tail", p: "a/missing/deeper", want: "a/missing/deeper"},
+		{name: "missing tail through symlink", p: "in/missing", want: "a/missing"},
+		{name: "missing tail going up out", p: "missing/../../x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := filepath.Join(root.path, filepath.FromSlash(test.base))
+			got, err := root.resolve(base, filepath.FromSlash(test.p))
+			if test.want == "" {
+				if status.Code(err) != codes.PermissionDenied {
+					t.Fatalf("resolve(%q) = %q, %v, want PermissionDenied", test.p, got, err)
+				}
+				return
+			}
+			want := filepath.Join(root.path, filepath.FromSlash(test.want))
+			if err != nil || got != want {
+				t.Fatalf("resolve(%q) = %q, %v, want %q", test.p, got, err, want)
+			}
+		})
+	}
+}
+
+func TestRootResolveEntry(t *testing.T) {
+	root, _ := newTestRoot(t)
+	tests := []struct {
+		name string
+		p    string
+		want string
+	}{
+		{name: "file", p: "a/b", want: "a/b"},
+		{name: "symlink itself", p: "in", want: "in"},
+		{name: "symlink out itself", p: "out", want: "out"},
+		{name: "through symlink", p: "in/b", want: "a/b"},
+		{name: "missing", p: "a/missing", want: "a/missing"},
+		{name: "root", p: "."},
+		{name: "root by dot dot", p: "a/.."},
+		{name: "absolute root", p: root.path},
+		{name: "dot dot out", p: "../x"},
+		{name: "through symlink out", p: "out/file"},
+		{name: "through symlink up out", p: "a/up/x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := root.resolveEntry(root.path, filepath.FromSlash(test.p))
+			if test.want == "" {
+				if status.Code(err) != codes.PermissionDenied {
+					t.Fatalf("resolveEntry(%q) = %q, %v, want PermissionDenied", test.p, got, err)
+				}
+				return
+			}
+			want := filepath.Join(root.path, filepath.FromSlash(test.want))
+			if err != nil || got != want {
+				t.Fatalf("resolveEntry(%q) = %q, %v, want %q", test.p, got, err, want)
+			}
+		})
+	}
+}
+
+func TestRootContains(t *testing.T) {
+	root := &rootDir{path: filepath.FromSlash("/srv/root")}
+	tests := []struct {
+		p    string
+		want bool
+	}{
+		{p: "/srv/root", want: true},
+		{p: "/srv/root/a", want: true},
+		{p: "/srv/root/a/../b", want: true},
+		{p: "/srv/root/..", want: false},
+		{p: "/srv/root/../x", want: false},
+		{p: "/srv/rootx", want: false},
+		{p: "/srv", want: false},
+		{p: "/", want: false},
+	}
+	for _, test := range tests {
+		if got := root.contains(filepath.FromSlash(test.p)); got != test.want {
+			t.Errorf("contains(%q) = %v, want %v", test.p, got, test.want)
+		}
+	}
+}
+
+func TestGlobConfined(t *testing.T) {
+	root, outside := newTestRoot(t)
+	if err := os.WriteFile(filepath.Join(outside, "secret"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := &defaultServer{root: root}
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+		code    codes.Code
+	}{
+		{name: "root", pattern: "*", want: []string{"a", "in", "out"}},
+		// symlinked directories are read only if they resolve in the root
+		{name: "through symlinks", pattern: "*/*", want: []string{"a/b", "a/up", "in/b", "in/up"}},
+		{name: "literal after pattern", pattern: "?n/b", want: []string{"in/b"}},
+		{name: "no meta", pattern: "a/b", want: []string{"a/b"}},
+		{name: "symlink out", pattern: "out/*", code: codes.PermissionDenied},
+		{name: "symlink up out", pattern: "a/up/*", code: codes.PermissionDenied},
+		{name: "dot dot out", pattern: "../*", code: codes.PermissionDenied},
+		{name: "absolute out", pattern: filepath.Join(outside, "*"), code: codes.PermissionDenied},
+		{name: "bad pattern", pattern: "[", code: codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := d.glob(root.path, filepath.FromSlash(test.pattern))
+			if test.code != codes.OK {
+				if status.Code(err) != test.code {
+					t.Fatalf("glob(%q) = %q, %v, want %v", test.pattern, matches, err, test.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, match := range matches {
+				rel, _ := filepath.Rel(root.path, match)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Fatalf("glob(%q) = %q, want %q", test.pattern, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDestination(t *testing.T) {
+	root, _ := newTestRoot(t)
+	src := filepath.Join(root.path, "src")
+	for _, file := range []string{src, filepath.Join(root.path, "f")} {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("f", filepath.Join(root.path, "lf")); err != nil {
+		t.Fatal(err)
+	}
+	d := &defaultServer{root: root}
+	ctx := withSession(context.Background(), &session{cwd: root.path})
+	tests := []struct {
+		name string
+		to   string
+		want string
+	}{
+		{name: "new", to: "new", want: "new"},
+		{name: "directory", to: "a", want: "a/src"},
+		{name: "root", to: ".", want: "src"},
+		{name: "root by dot dot", to: "a/..", want: "src"},
+		{name: "symlink to a file", to: "lf", want: "lf"},
+		{name: "symlink to a directory", to: "in", want: "in"},
+		{name: "symlink to a directory with a slash", to: "in/", want: "a/src"},
+		{name: "symlink out", to: "out", want: "out"},
+		{name: "symlink out with a slash", to: "out/"},
+		{name: "dot dot out", to: "../x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _, err := d.destination(ctx, src, test.to, "")
+			if test.want == "" {
+				if status.Code(err) != codes.PermissionDenied {
+					t.Fatalf("destination(%q) = %q, %v, want PermissionDenied", test.to, got, err)
+				}
+				return
+			}
+			want := filepath.Join(root.path, filepath.FromSlash(test.want))
+			if err != nil || got != want {
+				t.Fatalf("destination(%q) = %q, %v, want %q", test.to, got, err, want)
+			}
+		})
+	}
+}
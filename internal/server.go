@@ -5,29 +5,62 @@ import (
 	"errors"
 	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"got/pkg"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
-	"time"
 )
 
 const dirType = "dir"
 const fileType = "file"
 
-func CreateServer(port int) (GotServer, error) {
+const checksumKey = "checksum"
+const checksumAlgorithmKey = "checksum-algorithm"
+
+// fileChecksumKey requests the checksum of the whole file with a download from an offset,
+// sent in the trailer beside the checksum of the range
+const fileChecksumKey = "file-checksum"
+
+func CreateServer(config ServerConfig) (GotServer, error) {
 	server := &defaultServer{
-		port: port,
+		config: config,
 	}
 	return server, server.init()
 }
 
+type ServerConfig struct {
+	Port int
+	// Root is the directory all file access is confined to, the working directory if empty
+	Root string
+	// CertFile and KeyFile are the TLS certificate and key, required unless Insecure is set
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS, client certificates must be signed by it
+	ClientCAFile string
+	// StagingDir keeps uploads until they are complete, `staging` in ConfigDir if empty. It
+	// must be out of the root, and on the same filesystem for uploads to be moved in place.
+	StagingDir string
+	// UnTarLimits bounds the extraction of uploaded directories
+	UnTarLimits pkg.UnTarLimits
+	// TokensFile enables bearer token authentication, one `<name> <sha256>` per line
+	TokensFile string
+	// Compression is the compression algorithms the server accepts, none if empty
+	Compression []string
+	// ChunkSize is the data size of download messages, DefaultChunkSize if 0
+	ChunkSize int
+	// AdaptiveChunkSize grows the chunk size of downloads while the throughput improves
+	AdaptiveChunkSize bool
+	// MaxMessageSize bounds the size of gRPC messages, DefaultMaxMessageSize if 0
+	MaxMessageSize int
+	Insecure       bool
+}
+
 type GotServer interface {
 	init() error
 	Run() error
@@ -35,82 +68,193 @@ type GotServer interface {
 }
 
 type defaultServer struct {
-	port       int
+	config     ServerConfig
+	root       *rootDir
+	sessions   *sessionStore
+	staging    *stagingArea
 	grpcServer *grpc.Server
 }
 
 func (d *defaultServer) init() error {
-	d.grpcServer = grpc.NewServer()
-	RegisterGotServiceServer(d.grpcServer, &defaultServer{})
+	rootPath := d.config.Root
+	if rootPath == "" {
+		rootPath = "."
+	}
+	root, err := newRootDir(rootPath)
+	if err != nil {
+		return err
+	}
+	d.root = root
+	d.sessions = newSessionStore(root)
+
+	stagingDir := d.config.StagingDir
+	if stagingDir == "" {
+		if stagingDir, err = ConfigDir(); err != nil {
+			return err
+		}
+		stagingDir = filepath.Join(stagingDir, "staging")
+	}
+	// clients must not reach the partial uploads of others through the root
+	if stagingDir, err = filepath.Abs(stagingDir); err != nil {
+		return err
+	}
+	if _, err = root.resolve(root.path, stagingDir); err == nil {
+		return fmt.Errorf("staging directory %s is in the root %s", stagingDir, root.path)
+	} else if status.Code(err) != codes.PermissionDenied {
+		return err
+	}
+	if d.staging, err = newStagingArea(stagingDir); err != nil {
+		return err
+	}
+
+	for _, algorithm := range d.config.Compression {
+		if _, err = pkg.NewCompressor(algorithm, io.Discard); err != nil {
+			return err
+		}
+	}
+
+	if d.config.Insecure && d.config.ClientCAFile != "" {
+		return errors.New("client certificate authentication requires TLS")
+	}
+	if d.config.Insecure && d.config.TokensFile != "" {
+		return errors.New("token authentication requires TLS")
+	}
+
+	auth := &authenticator{requireAuth: d.config.ClientCAFile != "" || d.config.TokensFile != ""}
+	if d.config.TokensFile != "" {
+		tokens, err := loadTokens(d.config.TokensFile)
+		if err != nil {
+			return err
+		}
+		auth.tokens = tokens
+	}
+	if d.config.MaxMessageSize <= 0 {
+		d.config.MaxMessageSize = DefaultMaxMessageSize
+	}
+	var options = []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(auth.unaryInterceptor, d.sessions.unaryInterceptor),
+		grpc.ChainStreamInterceptor(auth.streamInterceptor, d.sessions.streamInterceptor),
+		grpc.MaxRecvMsgSize(d.config.MaxMessageSize),
+		grpc.MaxSendMsgSize(d.config.MaxMessageSize),
+	}
+	if !d.config.Insecure {
+		creds, err := serverCredentials(d.config)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	d.grpcServer = grpc.NewServer(options...)
+	RegisterGotServiceServer(d.grpcServer, d)
 	return nil
 }
 
 func (d *defaultServer) Run() error {
-	lisn, err := net.Listen("tcp", fmt.Sprintf(":%d", d.port))
+	lisn, err := net.Listen("tcp", fmt.Sprintf(":%d", d.config.Port))
 	if err != nil {
 		return err
 	}
 	return d.grpcServer.Serve(lisn)
 }
 
+// resolve returns the real path of `p` relative to the session's current directory,
+// confined to the root.
+func (d *defaultServer) resolve(ctx context.Context, p string) (string, error) {
+	return d.root.resolve(sessionFromContext(ctx).Cwd(), p)
+}
+
+// untarStatus maps the rejection of a tar archive to a gRPC status.
+func untarStatus(err error) error {
+	var untarErr *pkg.UnTarError
+	if !errors.As(err, &untarErr) {
+		return err
+	}
+	if errors.Is(err, pkg.ErrLimitExceeded) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.PermissionDenied, err.Error())
+}
+
 func (d *defaultServer) ListFile(ctx context.Context, req *ListFilesRequest) (*ListFilesResponse, error) {
-	p, _ := peer.FromContext(ctx)
-	log.Printf("%-12s called from: %s\n", "ListFile", p.Addr.String())
+	logCall(ctx, "ListFile")
 
-	wd, err := os.Getwd()
-	if err != nil {
-		return nil, err
+	cwd := sessionFromContext(ctx).Cwd()
+	wd := cwd
+	if req.Dir != "" {
+		var err error
+		if wd, err = d.resolve(ctx, req.Dir); err != nil {
+			return nil, err
+		}
 	}
-	filesInfo, err := ioutil.ReadDir(wd)
+	entries, err := listDir(wd)
 	if err != nil {
 		return nil, err
 	}
-	var info = fmt.Sprintf("%s:\n", wd)
-	for i := range filesInfo {
-		info += fmt.Sprintf("%-12s%-20s%-10d\n",
-			filesInfo[i].Mode(),
-			filesInfo[i].Name(),
-			filesInfo[i].Size(),
-		)
+	if err = grpc.SetHeader(ctx, metadata.Pairs(cwdKey, cwd)); err != nil {
+		return nil, err
 	}
-	info += fmt.Sprint("count: ", len(filesInfo))
-	return &ListFilesResponse{Info: info}, nil
+	return &ListFilesResponse{Dir: wd, Entries: entries}, nil
 }
 
 func (d *defaultServer) ChangeDir(ctx context.Context, req *ChangeDirRequest) (*ChangeDirResponse, error) {
-	p, _ := peer.FromContext(ctx)
-	log.Printf("%-12s called from: %s\n", "ChangeDir", p.Addr.String())
+	logCall(ctx, "ChangeDir")
 
-	err := os.Chdir(req.DstDir)
+	wd, err := d.resolve(ctx, req.DstDir)
 	if err != nil {
 		return nil, err
 	}
-	wd, err := os.Getwd()
+	entries, err := listDir(wd)
 	if err != nil {
 		return nil, err
 	}
+
+	// the session is kept once the client has a directory of its own
+	sess := sessionFromContext(ctx)
+	sess.setCwd(wd)
+	id, err := d.sessions.keep(sess)
+	if err != nil {
+		return nil, err
+	}
+	if err = grpc.SetHeader(ctx, metadata.Pairs(sessionKey, id, cwdKey, wd)); err != nil {
+		return nil, err
+	}
+	return &ChangeDirResponse{Dir: wd, Entries: entries}, nil
+}
+
+// listDir returns the entries of directory `wd` sorted by name.
+func listDir(wd string) ([]*FileEntry, error) {
+	stat, err := os.Stat(wd)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", wd)
+	} else if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is not a directory", wd)
+	}
 	filesInfo, err := ioutil.ReadDir(wd)
 	if err != nil {
 		return nil, err
 	}
-	var info = fmt.Sprintf("%s:\n", wd)
-	for i := range filesInfo {
-		info += fmt.Sprintf("%-12s%-20s%-10d\n",
-			filesInfo[i].Mode(),
-			filesInfo[i].Name(),
-			filesInfo[i].Size(),
-		)
+	entries := make([]*FileEntry, 0, len(filesInfo))
+	for _, info := range filesInfo {
+		entries = append(entries, NewFileEntry(wd, info))
 	}
-	info += fmt.Sprint("count: ", len(filesInfo))
-	return &ChangeDirResponse{Info: info}, nil
+	return entries, nil
 }
 
 func (d *defaultServer) UploadFile(stream GotService_UploadFileServer) error {
-	p, _ := peer.FromContext(stream.Context())
-	log.Printf("%-12s called from: %s\n", "UploadFile", p.Addr.String())
+	logCall(stream.Context(), "UploadFile")
 
 	var fileName string
 	var uploadType string
+	var algorithm string
+	var transferID string
+	var offset, length, size int64
+	var mode, mtime int64
+	var blockSize int64
+	var parallel string
+	var policy ConflictPolicy
 	md, ok := metadata.FromIncomingContext(stream.Context())
 	if ok {
 		if n := md.Get("name"); n != nil {
@@ -119,48 +263,251 @@ func (d *defaultServer) UploadFile(stream GotService_UploadFileServer) error {
 		if t := md.Get("type"); t != nil {
 			uploadType = t[0]
 		}
+		if a := md.Get(checksumAlgorithmKey); a != nil {
+			algorithm = a[0]
+		}
+		if id := md.Get(transferIDKey); id != nil {
+			transferID = id[0]
+		}
+		if o := md.Get(offsetKey); o != nil {
+			var err error
+			if offset, err = strconv.ParseInt(o[0], 10, 64); err != nil || offset < 0 {
+				return status.Errorf(codes.InvalidArgument, "invalid offset %q", o[0])
+			}
+		}
+		if c := md.Get(conflictKey); c != nil {
+			var err error
+			if policy, err = ParseConflictPolicy(c[0]); err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+		// files of a directory upload keep the mode and modification time of their source
+		var err error
+		if mode, err = metadataInt(md, "mode"); err != nil {
+			return err
+		}
+		if mtime, err = metadataInt(md, "mtime"); err != nil {
+			return err
+		}
+		if blockSize, err = metadataInt(md, deltaKey); err != nil {
+			return err
+		}
+		if blockSize > 0 {
+			if err = pkg.CheckBlockSize(blockSize); err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			if transferID != "" || uploadType != fileType {
+				return status.Error(codes.InvalidArgument, "delta upload must be of a single file, not resumable")
+			}
+		}
+		if p := md.Get(parallelKey); p != nil {
+			if parallel, err = parseParallel(p[0], transferID); err != nil {
+				return err
+			}
+			if length, err = metadataInt(md, lengthKey); err != nil {
+				return err
+			}
+			if size, err = metadataInt(md, "size"); err != nil {
+				return err
+			}
+			if offset+length > size {
+				return status.Errorf(codes.InvalidArgument, "part %d+%d beyond size %d", offset, length, size)
+			}
+		}
 	} else {
 		return errors.New("file name not defined")
 	}
-
-	saveFile, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0664)
+	fileName, err := d.resolve(stream.Context(), fileName)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = saveFile.Close()
-		if uploadType == dirType {
-			err = os.Remove(fileName)
-		}
-	}()
+	checksum, err := pkg.NewChecksum(algorithm)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	for {
-		resp, err := stream.Recv()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			_ = os.Remove(fileName)
+	// apply the conflict policy before receiving any data
+	target, skip, err := resolveConflict(fileName, policy)
+	if _, ok := err.(errExists); ok {
+		return status.Error(codes.AlreadyExists, err.Error())
+	} else if err != nil {
+		return err
+	}
+	if skip {
+		return stream.SendAndClose(&UploadFileResponse{Ok: true, Path: target, Skipped: true})
+	}
+
+	// the client waits for the negotiated compression and the max message size before
+	// sending data
+	header := metadata.Pairs(maxMessageSizeKey, strconv.Itoa(d.config.MaxMessageSize))
+	compression, offered := negotiateCompression(stream.Context(), d.config.Compression)
+	if offered {
+		header.Set(compressionKey, compression)
+	}
+	if err = stream.SendHeader(header); err != nil {
+		return err
+	}
+	if parallel == parallelCommit {
+		return d.commitParallel(stream, transferID, size, algorithm, target)
+	}
+
+	// a delta upload is applied to the existing file, also when saved under a new name
+	var base *os.File
+	var baseInfo os.FileInfo
+	if blockSize > 0 {
+		if base, baseInfo, err = openBase(fileName); err != nil {
 			return err
 		}
+		defer base.Close()
+	}
 
-		_, err = saveFile.Write(resp.Data)
+	// a file is received into a temporary file next to its destination and a directory is
+	// extracted while being received, a resumable upload is received into the staging area
+	// and keeps its partial data there when interrupted. A part of a parallel upload is
+	// written at its offset in the staging file shared by all parts
+	var output io.Writer
+	var atomicFile *pkg.AtomicFile
+	var extractor *dirExtractor
+	var stagingFile *os.File
+	var part *partWriter
+	switch {
+	case parallel == parallelPart:
+		stagingFile, err = d.staging.openParallel(stream.Context(), transferID, size)
+		if err != nil {
+			return err
+		}
+		defer stagingFile.Close()
+		part = &partWriter{w: &offsetWriter{w: stagingFile, offset: offset}, remaining: length}
+		output = part
+	case transferID == "" && uploadType == dirType:
+		extractor, err = newDirExtractor(target, d.config.UnTarLimits)
+		if err != nil {
+			return err
+		}
+		defer extractor.abort()
+		output = extractor
+	case transferID == "":
+		atomicFile, err = pkg.CreateAtomic(target, 0664)
+		if err != nil {
+			return err
+		}
+		defer atomicFile.Abort()
+		output = atomicFile
+	default:
+		stagingFile, err = d.staging.open(stream.Context(), transferID, offset, checksum)
 		if err != nil {
-			_ = os.Remove(fileName)
 			return err
 		}
+		defer func() {
+			_ = stagingFile.Close()
+			if err != nil && status.Code(err) == codes.DataLoss {
+				_ = os.Remove(stagingFile.Name())
+			}
+		}()
+		output = stagingFile
+	}
+
+	// data are decompressed and hashed while being written, the expected checksum comes
+	// with the last message
+	var expected string
+	messages := &messageReader{recv: func() ([]byte, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if req.Checksum != "" {
+			expected = req.Checksum
+		}
+		return req.Data, nil
+	}}
+	reader, err := decompressReader(compression, messages)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer reader.Close()
+	buf := getChunk(DefaultChunkSize)
+	defer putChunk(buf)
+	if base != nil {
+		if _, err = pkg.ApplyDelta(base, baseInfo.Size(), int(blockSize), reader, io.MultiWriter(output, checksum)); err != nil {
+			return deltaStatus(err)
+		}
+	} else if _, err = io.CopyBuffer(io.MultiWriter(output, checksum), reader, buf); err != nil {
+		return untarStatus(err)
+	}
+	// the checksum follows the end of the compressed data
+	if _, err = io.Copy(io.Discard, messages); err != nil {
+		return err
+	}
+	if expected != checksum.String() {
+		err = status.Errorf(codes.DataLoss, "checksum mismatch: expect %q, got %q", expected, checksum)
+		return err
 	}
 
-	if uploadType == dirType {
-		if err = pkg.UnTar(fileName, "."); err != nil {
+	// the upload is complete and verified, move it to its destination
+	switch {
+	case part != nil:
+		if part.remaining > 0 {
+			return status.Errorf(codes.InvalidArgument, "part is %d bytes short", part.remaining)
+		}
+		if err = stagingFile.Close(); err != nil {
+			return err
+		}
+		return stream.SendAndClose(&UploadFileResponse{Ok: ok, Checksum: checksum.String()})
+	case extractor != nil:
+		err = untarStatus(extractor.commit())
+	case atomicFile != nil:
+		err = atomicFile.Commit()
+	case uploadType == dirType:
+		err = d.extractStaged(stagingFile, target)
+	default:
+		if err = stagingFile.Close(); err == nil {
+			err = pkg.MoveFile(stagingFile.Name(), target, 0664)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if uploadType == fileType {
+		if err = setAttributes(target, os.FileMode(mode), mtime); err != nil {
 			return err
 		}
 	}
-	return stream.SendAndClose(&UploadFileResponse{Ok: ok})
+	return stream.SendAndClose(&UploadFileResponse{Ok: ok, Checksum: checksum.String(), Path: target})
+}
+
+// extractStaged extracts the staged tar of a resumable directory upload as `target`
+// and removes it from the staging area.
+func (d *defaultServer) extractStaged(stagingFile *os.File, target string) error {
+	defer os.Remove(stagingFile.Name())
+	if _, err := stagingFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	extractor, err := newDirExtractor(target, d.config.UnTarLimits)
+	if err != nil {
+		return err
+	}
+	defer extractor.abort()
+	if _, err = io.Copy(extractor, stagingFile); err != nil {
+		return untarStatus(err)
+	}
+	return untarStatus(extractor.commit())
+}
+
+func (d *defaultServer) UploadStatus(ctx context.Context, req *UploadStatusRequest) (*UploadStatusResponse, error) {
+	logCall(ctx, "UploadStatus")
+
+	if req.TransferId == "" {
+		return nil, status.Error(codes.InvalidArgument, "transfer ID not defined")
+	}
+	offset, err := d.staging.offset(ctx, req.TransferId)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadStatusResponse{Offset: offset}, nil
 }
 
 func (d *defaultServer) DownloadFile(req *DownloadFileRequest, stream GotService_DownloadFileServer) error {
-	p, _ := peer.FromContext(stream.Context())
-	log.Printf("%-12s called from: %s\n", "DownloadFile", p.Addr.String())
+	logCall(stream.Context(), "DownloadFile")
 
 	var err error
 	var filePath = req.Filepath
@@ -171,59 +518,135 @@ func (d *defaultServer) DownloadFile(req *DownloadFileRequest, stream GotService
 		}
 	}()
 
+	filePath, err = d.resolve(stream.Context(), filePath)
+	if err != nil {
+		return err
+	}
+	var algorithm string
+	var wholeFile bool
+	var limit = chunkLimit(d.config.MaxMessageSize)
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if a := md.Get(checksumAlgorithmKey); a != nil {
+			algorithm = a[0]
+		}
+		wholeFile = md.Get(fileChecksumKey) != nil
+		limit = peerChunkLimit(limit, md.Get(maxMessageSizeKey))
+	}
+	checksum, err := pkg.NewChecksum(algorithm)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// fileChecksum covers the whole file of a resumed download, the data before the offset
+	// are read into it instead of skipped
+	var fileChecksum *pkg.Checksum
+	compression, _ := negotiateCompression(stream.Context(), d.config.Compression)
+	if compression != "" {
+		mdMap[compressionKey] = compression
+	}
+	if req.Offset < 0 || req.Length < 0 {
+		err = status.Error(codes.InvalidArgument, "negative offset or length")
+		return err
+	}
 	info, err := os.Stat(filePath)
 	if err != nil {
 		return err
 	}
+	if info.IsDir() && (req.Offset > 0 || req.Length > 0) {
+		err = status.Error(codes.InvalidArgument, "range is not supported for directory")
+		return err
+	}
+	// a directory is sent as tar stream produced on the fly, its size is known in advance
+	var reader io.Reader
+	var size = info.Size()
 	if info.IsDir() {
-		dirTarPath := filepath.Join(filepath.Dir(filePath),
-			fmt.Sprintf("%s%d.tar", filepath.Base(filePath), time.Now().Unix()))
-		err := pkg.Tar(filePath, dirTarPath)
-		if err != nil {
+		mdMap["type"] = dirType
+		// the stream is written from the listing it is sized by
+		var listing *pkg.TarListing
+		if listing, err = pkg.ListTar(filePath); err != nil {
 			return err
 		}
-		mdMap["type"] = dirType
-
-		info, err = os.Stat(dirTarPath)
-		filePath = dirTarPath
-
-		defer func() {
-			_ = os.Remove(filePath)
+		size = listing.Size
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			_, err := listing.WriteTo(pw)
+			_ = pw.CloseWithError(err)
 		}()
+		reader = pr
 	} else {
 		mdMap["type"] = fileType
-	}
 
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0664)
-	if err != nil {
-		return err
+		var file *os.File
+		file, err = os.OpenFile(filePath, os.O_RDONLY, 0664)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// seek to the requested range
+		if req.Offset > size {
+			err = status.Errorf(codes.OutOfRange, "offset %d beyond file size %d", req.Offset, size)
+			return err
+		}
+		if wholeFile && req.Offset > 0 && req.Length == 0 {
+			fileChecksum, _ = pkg.NewChecksum(algorithm)
+			_, err = io.CopyN(fileChecksum, file, req.Offset)
+		} else {
+			_, err = file.Seek(req.Offset, io.SeekStart)
+		}
+		if err != nil {
+			return err
+		}
+		reader = file
+		if req.Length > 0 {
+			reader = io.LimitReader(file, req.Length)
+		}
 	}
-	defer file.Close()
 
-	mdMap["size"] = strconv.FormatInt(info.Size(), 10)
+	// size and mtime describe the whole source, for resuming against the same version
+	mdMap["size"] = strconv.FormatInt(size, 10)
+	mdMap["mtime"] = strconv.FormatInt(info.ModTime().UnixNano(), 10)
 	md := metadata.New(mdMap)
 	err = stream.SetHeader(md)
 	if err != nil {
 		return err
 	}
 
-	chunk := make([]byte, 4*(1<<10))
+	// the checksum covers the uncompressed data, messages fit in what both sides accept
+	output, err := compressWriter(compression, &messageWriter{size: limit, send: func(p []byte) error {
+		return stream.Send(&DownloadFileResponse{Data: p})
+	}})
+	if err != nil {
+		return err
+	}
+	sizer := newChunkSizer(d.config.ChunkSize, d.config.AdaptiveChunkSize, limit)
+	defer sizer.release()
 	for {
-		n, err := file.Read(chunk)
+		chunk := sizer.chunk()
+		n, err := io.ReadFull(reader, chunk)
 		if err == io.EOF {
 			break
-		} else if err != nil {
+		} else if err != nil && err != io.ErrUnexpectedEOF {
 			return err
 		}
-		if n < len(chunk) {
-			chunk = chunk[:n]
+		_, _ = checksum.Write(chunk[:n])
+		if fileChecksum != nil {
+			_, _ = fileChecksum.Write(chunk[:n])
 		}
-		err = stream.Send(&DownloadFileResponse{
-			Data: chunk,
-		})
-		if err != nil {
+		if _, err = output.Write(chunk[:n]); err != nil {
 			return err
 		}
+		sizer.sent(n)
+	}
+	if err = output.Close(); err != nil {
+		return err
+	}
+
+	// the checksum of all sent data of the range is verified by the client at the end
+	trailer := metadata.Pairs(checksumKey, checksum.String())
+	if fileChecksum != nil {
+		trailer.Set(fileChecksumKey, fileChecksum.String())
 	}
+	stream.SetTrailer(trailer)
 	return nil
 }
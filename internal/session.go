@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"os"
+	"sync"
+	"time"
+)
+
+const sessionKey = "session"
+const cwdKey = "cwd"
+
+// sessionIdleTimeout is how long an unused session is kept by the server.
+const sessionIdleTimeout = 24 * time.Hour
+
+// sessionSweepInterval is how often idle sessions are dropped.
+const sessionSweepInterval = time.Hour
+
+// session is the per-client state of the server, it holds the current directory
+// every relative path of the client is resolved against.
+type session struct {
+	id       string
+	identity string
+
+	mu       sync.Mutex
+	cwd      string
+	lastUsed time.Time
+}
+
+func (s *session) Cwd() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cwd
+}
+
+func (s *session) setCwd(cwd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cwd = cwd
+}
+
+type sessionCtxKey struct{}
+
+func withSession(ctx context.Context, s *session) context.Context {
+	return context.WithValue(ctx, sessionCtxKey{}, s)
+}
+
+func sessionFromContext(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionCtxKey{}).(*session)
+	return s
+}
+
+// sessionStore issues and tracks the sessions of a server.
+type sessionStore struct {
+	root     *rootDir
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore(root *rootDir) *sessionStore {
+	store := &sessionStore{root: root, sessions: make(map[string]*session)}
+	go func() {
+		for range time.Tick(sessionSweepInterval) {
+			store.sweep()
+		}
+	}()
+	return store
+}
+
+// get returns the session named in the request metadata, or a new session if the
+// session is unknown or belongs to another identity. A new session starts at the
+// directory the client remembers if it is valid, else at the root. It is kept only
+// once the client changes its directory, see keep.
+func (s *sessionStore) get(ctx context.Context) *session {
+	identity := IdentityFromContext(ctx)
+	var id, cwd string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(sessionKey); v != nil {
+			id = v[0]
+		}
+		if v := md.Get(cwdKey); v != nil {
+			cwd = v[0]
+		}
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	s.mu.Unlock()
+	if ok && sess.identity == identity {
+		sess.mu.Lock()
+		sess.lastUsed = now
+		sess.mu.Unlock()
+		return sess
+	}
+
+	sess = &session{identity: identity, cwd: s.root.path, lastUsed: now}
+	if cwd != "" {
+		if dir, err := s.root.resolve(s.root.path, cwd); err == nil {
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				sess.cwd = dir
+			}
+		}
+	}
+	return sess
+}
+
+// keep stores new session `sess` so that later requests find it, it returns its ID.
+func (s *sessionStore) keep(sess *session) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.id == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return "", err
+		}
+		sess.id = id
+		s.sessions[id] = sess
+	}
+	return sess.id, nil
+}
+
+// sweep drops the sessions unused for sessionIdleTimeout.
+func (s *sessionStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, sess := range s.sessions {
+		sess.mu.Lock()
+		idle := now.Sub(sess.lastUsed)
+		sess.mu.Unlock()
+		if idle > sessionIdleTimeout {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *sessionStore) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	sess := s.get(ctx)
+	if sess.id != "" {
+		if err := grpc.SetHeader(ctx, metadata.Pairs(sessionKey, sess.id)); err != nil {
+			return nil, err
+		}
+	}
+	return handler(withSession(ctx, sess), req)
+}
+
+func (s *sessionStore) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	sess := s.get(stream.Context())
+	if sess.id != "" {
+		if err := stream.SetHeader(metadata.Pairs(sessionKey, sess.id)); err != nil {
+			return err
+		}
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: withSession(stream.Context(), sess)})
+}
+
+// sessionState is the session a client remembers for a server between invocations.
+type sessionState struct {
+	Session string `json:"session"`
+	Cwd     string `json:"cwd"`
+}
+
+// loadSessionState returns the state remembered for `addr` in the sessions file.
+func loadSessionState(path string, addr string) (sessionState, error) {
+	states, err := readSessionStates(path)
+	if err != nil {
+		return sessionState{}, err
+	}
+	return states[addr], nil
+}
+
+// saveSessionState remembers the state of `addr` in the sessions file.
+func saveSessionState(path string, addr string, state sessionState) error {
+	states, err := readSessionStates(path)
+	if err != nil {
+		return err
+	}
+	if states[addr] == state {
+		return nil
+	}
+	states[addr] = state
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readSessionStates(path string) (map[string]sessionState, error) {
+	states := make(map[string]sessionState)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"google.golang.org/grpc/metadata"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// requestContext returns the context of a request of `identity` naming session `id` and
+// remembering directory `cwd`, empty values are not sent.
+func requestContext(identity string, id string, cwd string) context.Context {
+	md := metadata.MD{}
+	if id != "" {
+		md.Set(sessionKey, id)
+	}
+	if cwd != "" {
+		md.Set(cwdKey, cwd)
+	}
+	return WithIdentity(metadata.NewIncomingContext(context.Background(), md), identity)
+}
+
+func TestSessionStoreGet(t *testing.T) {
+	root, outside := newTestRoot(t)
+	store := &sessionStore{root: root, sessions: make(map[string]*session)}
+	kept := store.get(requestContext("alice", "", "a"))
+	id, err := store.keep(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		identity string
+		id       string
+		cwd      string
+		kept     bool
+		want     string
+	}{
+		{name: "kept session", identity: "alice", id: id, kept: true, want: "a"},
+		{name: "kept session ignores the remembered directory", identity: "alice", id: id, cwd: "a/b", kept: true, want: "a"},
+		{name: "session of another identity", identity: "bob", id: id, want: "."},
+		{name: "session of another identity at its directory", identity: "bob", id: id, cwd: "a/b", want: "a/b"},
+		{name: "unknown session", identity: "alice", id: "unknown", want: "."},
+		{name: "remembered directory", identity: "alice", cwd: "a/b", want: "a/b"},
+		{name: "remembered directory through symlink", identity: "alice", cwd: "in/b", want: "a/b"},
+		{name: "remembered directory missing", identity: "alice", cwd: "a/missing", want: "."},
+		{name: "remembered directory out of the root", identity: "alice", cwd: outside, want: "."},
+		{name: "remembered directory through symlink out", identity: "alice", cwd: "out", want: "."},
+		{name: "no metadata", want: "."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sess := store.get(requestContext(test.identity, test.id, filepath.FromSlash(test.cwd)))
+			if (sess == kept) != test.kept {
+				t.Fatalf("get returned the kept session: %v, want %v", sess == kept, test.kept)
+			}
+			if !test.kept && sess.id != "" {
+				t.Fatalf("new session has ID %q before it is kept", sess.id)
+			}
+			if want := filepath.Join(root.path, filepath.FromSlash(test.want)); sess.Cwd() != want {
+				t.Fatalf("session at %q, want %q", sess.Cwd(), want)
+			}
+		})
+	}
+}
+
+func TestSessionStoreKeep(t *testing.T) {
+	root, _ := newTestRoot(t)
+	store := &sessionStore{root: root, sessions: make(map[string]*session)}
+	ctx := requestContext("alice", "", "")
+
+	sess := store.get(ctx)
+	if len(store.sessions) != 0 {
+		t.Fatal("a session is kept before the client changes its directory")
+	}
+	// a session is kept across several changes of directory under the same ID
+	sess.setCwd(filepath.Join(root.path, "a"))
+	id, err := store.keep(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.setCwd(filepath.Join(root.path, "a", "b"))
+	if again, err := store.keep(sess); err != nil || again != id {
+		t.Fatalf("keep again = %q, %v, want %q", again, err, id)
+	}
+	if len(store.sessions) != 1 {
+		t.Fatalf("%d sessions kept, want 1", len(store.sessions))
+	}
+	if got := store.get(requestContext("alice", id, "")); got != sess || got.Cwd() != filepath.Join(root.path, "a", "b") {
+		t.Fatalf("get(%q) does not return the kept session at a/b", id)
+	}
+}
+
+func TestSessionStoreSweep(t *testing.T) {
+	root, _ := newTestRoot(t)
+	store := &sessionStore{root: root, sessions: make(map[string]*session)}
+	now := time.Now()
+	idle := map[string]time.Duration{
+		"fresh":   0,
+		"used":    sessionIdleTimeout - time.Minute,
+		"idle":    sessionIdleTimeout + time.Minute,
+		"old":     2 * sessionIdleTimeout,
+		"touched": 2 * sessionIdleTimeout,
+	}
+	for id, d := range idle {
+		store.sessions[id] = &session{id: id, identity: "alice", cwd: root.path, lastUsed: now.Add(-d)}
+	}
+	// a request uses its session again
+	store.get(requestContext("alice", "touched", ""))
+
+	store.sweep()
+	for id, want := range map[string]bool{"fresh": true, "used": true, "idle": false, "old": false, "touched": true} {
+		if _, ok := store.sessions[id]; ok != want {
+			t.Errorf("session %s kept: %v, want %v", id, ok, want)
+		}
+	}
+}
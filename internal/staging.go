@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const transferIDKey = "transfer-id"
+const offsetKey = "offset"
+
+// stagingExpiry is how long a partial upload is kept in the staging area.
+const stagingExpiry = 7 * 24 * time.Hour
+
+// stagingCleanInterval is how often expired partial uploads are removed.
+const stagingCleanInterval = time.Hour
+
+// stagingArea keeps the data of uploads until they are complete and verified.
+// Partial data of a resumable upload is kept under its transfer ID, scoped by
+// the identity of the uploader, so an interrupted upload can be continued.
+type stagingArea struct {
+	dir string
+}
+
+func newStagingArea(dir string) (*stagingArea, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	staging := &stagingArea{dir: dir}
+	staging.clean()
+	go func() {
+		for range time.Tick(stagingCleanInterval) {
+			staging.clean()
+		}
+	}()
+	return staging, nil
+}
+
+// clean removes expired partial uploads.
+func (s *stagingArea) clean() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > stagingExpiry {
+			_ = os.Remove(filepath.Join(s.dir, entry.Name()))
+		}
+	}
+}
+
+// path returns the staging file of a resumable transfer.
+func (s *stagingArea) path(ctx context.Context, transferID string) string {
+	sum := sha256.Sum256([]byte(IdentityFromContext(ctx) + "\x00" + transferID))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".part")
+}
+
+// offset returns the bytes already staged for a resumable transfer.
+func (s *stagingArea) offset(ctx context.Context, transferID string) (int64, error) {
+	info, err := os.Stat(s.path(ctx, transferID))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// open returns the staging file of an upload positioned at `offset`, with the staged data
+// before `offset` written to `checksum`. Uploads without transfer ID get a new temporary
+// file and always start at offset 0.
+func (s *stagingArea) open(ctx context.Context, transferID string, offset int64, checksum io.Writer) (*os.File, error) {
+	if transferID == "" {
+		if offset != 0 {
+			return nil, status.Error(codes.InvalidArgument, "offset requires a transfer ID")
+		}
+		return os.CreateTemp(s.dir, "upload-*.tmp")
+	}
+
+	file, err := os.OpenFile(s.path(ctx, transferID), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if offset > info.Size() {
+		_ = file.Close()
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"offset %d beyond the %d staged bytes", offset, info.Size())
+	}
+	if err = file.Truncate(offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if _, err = io.CopyN(checksum, file, offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// openParallel returns the staging file of a parallel upload of `size` bytes, its parts
+// are written concurrently at their offsets.
+func (s *stagingArea) openParallel(ctx context.Context, transferID string, size int64) (*os.File, error) {
+	file, err := os.OpenFile(s.path(ctx, transferID), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	// growing the file never discards the data other parts have written
+	if info.Size() < size {
+		if err = file.Truncate(size); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
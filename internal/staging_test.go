@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// stage writes `data` as the staged data of `transferID` of the identity of `ctx`.
+func stage(t *testing.T, s *stagingArea, ctx context.Context, transferID string, data string) {
+	t.Helper()
+	file, err := s.open(ctx, transferID, 0, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStagingKeys(t *testing.T) {
+	s := &stagingArea{dir: t.TempDir()}
+	alice := WithIdentity(context.Background(), "alice")
+	stage(t, s, alice, "t1", "alice t1")
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		transferID string
+		want       int64
+	}{
+		{name: "same identity and transfer", ctx: alice, transferID: "t1", want: int64(len("alice t1"))},
+		{name: "other transfer", ctx: alice, transferID: "t2"},
+		{name: "other identity", ctx: WithIdentity(context.Background(), "bob"), transferID: "t1"},
+		{name: "anonymous", ctx: context.Background(), transferID: "t1"},
+		// the identity and the transfer ID are not simply concatenated
+		{name: "shifted boundary", ctx: WithIdentity(context.Background(), "alicet"), transferID: "1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			offset, err := s.offset(test.ctx, test.transferID)
+			if err != nil || offset != test.want {
+				t.Fatalf("offset = %d, %v, want %d", offset, err, test.want)
+			}
+			if same := s.path(test.ctx, test.transferID) == s.path(alice, "t1"); same != (test.want > 0) {
+				t.Fatalf("shares the staging file of alice t1: %v", same)
+			}
+		})
+	}
+}
+
+func TestStagingOpen(t *testing.T) {
+	s := &stagingArea{dir: t.TempDir()}
+	ctx := WithIdentity(context.Background(), "alice")
+	stage(t, s, ctx, "t", "0123456789")
+
+	tests := []struct {
+		name       string
+		transferID string
+		offset     int64
+		want       string
+		code       codes.Code
+	}{
+		{name: "resume at the end", transferID: "t", offset: 10, want: "0123456789"},
+		{name: "resume before the end", transferID: "t", offset: 4, want: "0123"},
+		{name: "restart", transferID: "t", offset: 0, want: ""},
+		{name: "beyond the staged data", transferID: "t", offset: 11, code: codes.FailedPrecondition},
+		{name: "offset without transfer ID", offset: 1, code: codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stage(t, s, ctx, "t", "0123456789")
+			var checksum bytes.Buffer
+			file, err := s.open(ctx, test.transferID, test.offset, &checksum)
+			if test.code != codes.OK {
+				if status.Code(err) != test.code {
+					t.Fatalf("open at %d = %v, want %v", test.offset, err, test.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			// the staged data before the offset are kept and read into the checksum
+			if checksum.String() != test.want {
+				t.Fatalf("checksum of %q, want %q", checksum.String(), test.want)
+			}
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != test.offset {
+				t.Fatalf("staged file of %d bytes, want %d", info.Size(), test.offset)
+			}
+		})
+	}
+}
+
+func TestStagingClean(t *testing.T) {
+	s := &stagingArea{dir: t.TempDir()}
+	ctx := WithIdentity(context.Background(), "alice")
+	ages := map[string]time.Duration{
+		"fresh":   0,
+		"old":     stagingExpiry - time.Hour,
+		"expired": stagingExpiry + time.Hour,
+	}
+	for transferID, age := range ages {
+		stage(t, s, ctx, transferID, "data")
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(s.path(ctx, transferID), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.clean()
+	for transferID, age := range ages {
+		_, err := os.Stat(s.path(ctx, transferID))
+		if kept := err == nil; kept != (age < stagingExpiry) {
+			t.Errorf("%s upload kept: %v", transferID, kept)
+		}
+	}
+	if entries, err := os.ReadDir(s.dir); err != nil || len(entries) != 2 {
+		t.Errorf("%d staging files left, %v, want 2", len(entries), err)
+	}
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"got/pkg"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// StatOptions controls the status of a remote path.
+type StatOptions struct {
+	// Follow reports the target of a symlink instead of the symlink
+	Follow bool
+	// Checksum computes the checksum of a file with the checksum algorithm of the client
+	Checksum bool
+}
+
+// FileStat is the status of a remote path.
+type FileStat struct {
+	// Path is the path resolved by the server
+	Path string
+	*FileEntry
+	// Checksum is the checksum of a file as `<algorithm>:<hex>`, only if requested
+	Checksum string
+}
+
+func (d *defaultServer) Stat(ctx context.Context, req *StatRequest) (*StatResponse, error) {
+	logCall(ctx, "Stat")
+
+	p, err := d.resolve(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	stat := os.Stat
+	if !req.Follow {
+		// a symlink is reported itself, the root has none to report
+		if entry, err := d.root.resolveEntry(sessionFromContext(ctx).Cwd(), req.Name); err == nil {
+			p, stat = entry, os.Lstat
+		}
+	}
+	info, err := stat(p)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", req.Name)
+	} else if err != nil {
+		return nil, err
+	}
+	resp := &StatResponse{Entry: NewFileEntry(filepath.Dir(p), info), Path: p}
+	if req.ChecksumAlgorithm != "" && info.Mode().IsRegular() {
+		checksum, err := pkg.NewChecksum(req.ChecksumAlgorithm)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if _, err = io.Copy(checksum, file); err != nil {
+			return nil, err
+		}
+		resp.Checksum = checksum.String()
+	}
+	return resp, nil
+}
+
+// Stat returns the status of remote path `name`, the current directory if empty.
+func (d *defaultClient) Stat(name string, options StatOptions) (FileStat, error) {
+	req := &StatRequest{Name: name, Follow: options.Follow}
+	if options.Checksum {
+		if req.ChecksumAlgorithm = d.config.ChecksumAlgorithm; req.ChecksumAlgorithm == "" {
+			req.ChecksumAlgorithm = pkg.DefaultChecksumAlgorithm
+		}
+	}
+	var header metadata.MD
+	resp, err := d.grpcClient.Stat(d.context(nil), req, grpc.Header(&header))
+	if err != nil {
+		return FileStat{}, err
+	}
+	return FileStat{Path: resp.Path, FileEntry: resp.Entry, Checksum: resp.Checksum}, d.updateSession(header)
+}
+
+// remoteDir checks that remote path `name` is a directory, or a symlink to one. It fails
+// with `codes.NotFound` if it is missing and `codes.FailedPrecondition` if it is another
+// type. Servers without Stat are asked for a listing of the directory.
+func (d *defaultClient) remoteDir(name string) error {
+	stat, err := d.Stat(name, StatOptions{Follow: true})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		_, _, err = d.ListFiles(name)
+		return err
+	case err != nil:
+		return err
+	case !stat.IsDir():
+		return status.Errorf(codes.FailedPrecondition, "%s is not a directory", name)
+	}
+	return nil
+}
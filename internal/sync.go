@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"got/pkg"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Actions of a sync, done in this order.
+const (
+	// SyncDelete removes an entry of the destination, a directory with its content
+	SyncDelete = "delete"
+	// SyncMkdir creates a directory
+	SyncMkdir = "mkdir"
+	// SyncLink creates or replaces a symlink
+	SyncLink = "link"
+	// SyncCopy transfers a new or changed file
+	SyncCopy = "copy"
+)
+
+// SyncOptions controls a sync of a local and a remote directory.
+type SyncOptions struct {
+	// Pull mirrors the remote directory to the local one, the local one is mirrored otherwise
+	Pull bool
+	// Checksum compares files of the same size by checksum instead of modification time
+	Checksum bool
+	// Delete removes entries of the destination which are not in the source
+	Delete bool
+	// DryRun plans the actions without doing them
+	DryRun bool
+	// Transfer controls the transfer of the files, its conflict policy is ignored
+	Transfer TransferOptions
+}
+
+// SyncAction is an action of a sync on `Path`, relative to the synced directories and slash separated.
+type SyncAction struct {
+	Action string
+	Path   string
+	// Size is the size of a file to copy
+	Size int64
+
+	entry *ManifestEntry
+}
+
+// SyncResult is the outcome of a sync.
+type SyncResult struct {
+	// Actions are the actions planned, they are done unless the sync is a dry run
+	Actions []SyncAction
+	// Files counts the files transferred, Failed lists the entries which failed
+	Files  int
+	Failed []FileError
+}
+
+// Sync mirrors directory `localPath` to `remotePath` on the server, or the other way for
+// options.Pull. Only new or changed files are transferred.
+func (d *defaultClient) Sync(localPath string, remotePath string, options SyncOptions) (SyncResult, error) {
+	var algorithm string
+	if options.Checksum {
+		if algorithm = d.config.ChecksumAlgorithm; algorithm == "" {
+			algorithm = pkg.DefaultChecksumAlgorithm
+		}
+	}
+	localRoot, local, err := localManifest(localPath, algorithm)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	remote, err := d.remoteManifest(remotePath, algorithm)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	src, dst := local, remote
+	if options.Pull {
+		src, dst = remote, local
+	}
+	switch {
+	case options.Pull && remote == nil:
+		return SyncResult{}, fmt.Errorf("remote %s does not exist", remotePath)
+	case !options.Pull && local == nil:
+		return SyncResult{}, fmt.Errorf("%s does not exist", localPath)
+	}
+
+	result := SyncResult{Actions: planSync(src, dst, options)}
+	if options.DryRun {
+		return result, nil
+	}
+	if options.Pull {
+		err = d.pullSync(localPath, remotePath, options.Transfer, &result)
+	} else {
+		err = d.pushSync(localRoot, remotePath, options.Transfer, &result)
+	}
+	return result, err
+}
+
+// localManifest returns the real path of local directory `dir` and its manifest with
+// checksums of `algorithm` if not empty, a nil manifest if `dir` does not exist.
+func localManifest(dir string, algorithm string) (string, []*ManifestEntry, error) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return dir, nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	if !info.IsDir() {
+		return "", nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	entries, err := buildManifest(root)
+	if err != nil {
+		return "", nil, err
+	}
+	if algorithm != "" {
+		if err = checksumManifest(root, entries, algorithm); err != nil {
+			return "", nil, err
+		}
+	}
+	// an empty directory is told apart from a missing one
+	if entries == nil {
+		entries = []*ManifestEntry{}
+	}
+	return root, entries, nil
+}
+
+// remoteManifest returns the manifest of remote directory `dir` as localManifest.
+func (d *defaultClient) remoteManifest(dir string, algorithm string) ([]*ManifestEntry, error) {
+	var header metadata.MD
+	resp, err := d.grpcClient.DownloadManifest(d.context(nil),
+		&DownloadManifestRequest{Name: dir, ChecksumAlgorithm: algorithm}, grpc.Header(&header))
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = d.updateSession(header); err != nil {
+		return nil, err
+	}
+	if resp.Entries == nil {
+		return []*ManifestEntry{}, nil
+	}
+	return resp.Entries, nil
+}
+
+// planSync returns the actions turning `dst` into a mirror of `src`. Entries of `dst`
+// not in `src` are deleted for options.Delete, entries of another type are always replaced.
+func planSync(src []*ManifestEntry, dst []*ManifestEntry, options SyncOptions) []SyncAction {
+	srcByPath := make(map[string]*ManifestEntry, len(src))
+	for _, entry := range src {
+		srcByPath[entry.Path] = entry
+	}
+	dstByPath := make(map[string]*ManifestEntry, len(dst))
+	for _, entry := range dst {
+		dstByPath[entry.Path] = entry
+	}
+
+	// a deleted directory takes its content with it
+	var actions []SyncAction
+	deletedDirs := make(map[string]bool)
+	for _, entry := range dst {
+		if underAny(entry.Path, deletedDirs) {
+			continue
+		}
+		s, ok := srcByPath[entry.Path]
+		if (ok && s.Type == entry.Type) || (!ok && !options.Delete) {
+			continue
+		}
+		actions = append(actions, SyncAction{Action: SyncDelete, Path: entry.Path})
+		if entry.Type == dirType {
+			deletedDirs[entry.Path] = true
+		}
+	}
+
+	for _, entry := range src {
+		existing, ok := dstByPath[entry.Path]
+		exists := ok && existing.Type == entry.Type
+		switch {
+		case entry.Type == dirType && !exists:
+			actions = append(actions, SyncAction{Action: SyncMkdir, Path: entry.Path, entry: entry})
+		case entry.Type == symlinkType && (!exists || existing.Link != entry.Link):
+			actions = append(actions, SyncAction{Action: SyncLink, Path: entry.Path, entry: entry})
+		case entry.Type == fileType && (!exists || !sameContent(entry, existing, options.Checksum)):
+			actions = append(actions, SyncAction{Action: SyncCopy, Path: entry.Path, Size: entry.Size, entry: entry})
+		}
+	}
+	return actions
+}
+
+// underAny reports whether slash separated path `p` is inside any of `dirs`.
+func underAny(p string, dirs map[string]bool) bool {
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if dirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// sameContent reports whether files `a` and `b` are the same by size and modification
+// time, or by size and checksum if `byChecksum` is set.
+func sameContent(a *ManifestEntry, b *ManifestEntry, byChecksum bool) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	if byChecksum {
+		return a.Checksum != "" && a.Checksum == b.Checksum
+	}
+	return sameMtime(a.Mtime, b.Mtime)
+}
+
+// syncEntries returns the entries of the actions of `action`.
+func syncEntries(result *SyncResult, action string) []*ManifestEntry {
+	var entries []*ManifestEntry
+	for _, a := range result.Actions {
+		if a.Action == action {
+			entries = append(entries, a.entry)
+		}
+	}
+	return entries
+}
+
+// syncFailed records the failure of an action, it returns the error to stop the sync with
+// unless `options` continue on errors.
+func syncFailed(result *SyncResult, options TransferOptions, p string, err error) error {
+	result.Failed = append(result.Failed, FileError{Path: p, Err: err})
+	if options.ContinueOnError {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", p, err)
+}
+
+// pushSync does the actions of `result` on remote directory `remotePath`, mirroring local
+// directory `localRoot`.
+func (d *defaultClient) pushSync(localRoot string, remotePath string, options TransferOptions, result *SyncResult) error {
+	for _, a := range result.Actions {
+		if a.Action != SyncDelete {
+			continue
+		}
+		if err := d.Remove(path.Join(remotePath, a.Path), true); err != nil {
+			if err = syncFailed(result, options, a.Path, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the server creates the directory, its subdirectories and symlinks
+	var header metadata.MD
+	resp, err := d.grpcClient.UploadManifest(d.context(nil), &UploadManifestRequest{
+		Name:     remotePath,
+		Conflict: string(ConflictOverwrite),
+		Entries:  append(syncEntries(result, SyncMkdir), syncEntries(result, SyncLink)...),
+	}, grpc.Header(&header))
+	if err != nil {
+		return err
+	}
+	if err = d.updateSession(header); err != nil {
+		return err
+	}
+
+	files := syncEntries(result, SyncCopy)
+	if len(files) == 0 {
+		return nil
+	}
+	var transfer TransferResult
+	remote := filepath.ToSlash(resp.Name)
+	err = d.transferFiles("upload", files, options, &transfer,
+		func(ctx context.Context, entry *ManifestEntry, push chan<- int64) (int64, error) {
+			return d.uploadEntry(ctx, filepath.Join(localRoot, filepath.FromSlash(entry.Path)),
+				path.Join(remote, entry.Path), entry, options.Delta, push)
+		})
+	result.Files = transfer.Files
+	result.Failed = append(result.Failed, transfer.Failed...)
+	return err
+}
+
+// pullSync does the actions of `result` on local directory `localPath`, mirroring remote
+// directory `remotePath`.
+func (d *defaultClient) pullSync(localPath string, remotePath string, options TransferOptions, result *SyncResult) error {
+	if err := os.MkdirAll(localPath, os.ModeDir|0755); err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return err
+	}
+
+	// entries of the server are checked as those of a downloaded directory, files included,
+	// before any local entry is deleted. The files copied are those of the sync, which may
+	// differ only by checksum
+	files := syncEntries(result, SyncCopy)
+	entries := append(append(syncEntries(result, SyncMkdir), syncEntries(result, SyncLink)...), files...)
+	if err = checkManifest(root, entries, pkg.DefaultUnTarLimits); err != nil {
+		return err
+	}
+	for _, a := range result.Actions {
+		if a.Action != SyncDelete {
+			continue
+		}
+		p, err := pkg.EntryPath(root, a.Path, 0)
+		if err == nil {
+			err = os.RemoveAll(p)
+		}
+		if err != nil {
+			if err = syncFailed(result, options, a.Path, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = applyManifest(root, entries, pkg.DefaultUnTarLimits); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	var transfer TransferResult
+	err = d.downloadEntries(filepath.ToSlash(remotePath), root, files, options, &transfer)
+	result.Files = transfer.Files
+	result.Failed = append(result.Failed, transfer.Failed...)
+	return err
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// DirListing is a directory listed by a walk.
+type DirListing struct {
+	Dir     string
+	Entries []*FileEntry
+	// Err is the error reading the directory, its entries are not listed then
+	Err error
+}
+
+// DirWalker returns the directories of a walk in the order of ls -R: a directory, then
+// each of its subdirectories with their own. Symlinks to directories are not followed.
+type DirWalker interface {
+	// Next returns the next directory, io.EOF after the last one
+	Next() (*DirListing, error)
+	// Close ends the walk before its last directory
+	Close()
+}
+
+// Descends reports whether a walk of `maxDepth` levels lists `entry` of a directory of level
+// `depth`, the walked directory is level 1.
+func Descends(entry *FileEntry, depth int, maxDepth int) bool {
+	return entry.IsDir() && (maxDepth <= 0 || depth < maxDepth)
+}
+
+// WalkDir walks local directory `dir` down to `maxDepth` levels, all if 0. Entries starting
+// with '.' are listed only if `all`.
+func WalkDir(dir string, maxDepth int, all bool) DirWalker {
+	return &localWalker{maxDepth: maxDepth, all: all, pending: []pendingDir{{path: dir, depth: 1}}}
+}
+
+type localWalker struct {
+	maxDepth int
+	all      bool
+	// pending are the directories left, the next one last
+	pending []pendingDir
+}
+
+type pendingDir struct {
+	path  string
+	depth int
+}
+
+func (w *localWalker) Next() (*DirListing, error) {
+	if len(w.pending) == 0 {
+		return nil, io.EOF
+	}
+	dir := w.pending[len(w.pending)-1]
+	w.pending = w.pending[:len(w.pending)-1]
+	entries, err := listDir(dir.path)
+	if err != nil {
+		// the walked directory fails the walk, the others are listed with their error
+		if dir.depth == 1 {
+			w.pending = nil
+			return nil, err
+		}
+		return &DirListing{Dir: dir.path, Err: err}, nil
+	}
+	listing := &DirListing{Dir: dir.path, Entries: entries[:0]}
+	for _, entry := range entries {
+		if w.all || !strings.HasPrefix(entry.Name, ".") {
+			listing.Entries = append(listing.Entries, entry)
+		}
+	}
+	for i := len(listing.Entries) - 1; i >= 0; i-- {
+		if entry := listing.Entries[i]; Descends(entry, dir.depth, w.maxDepth) {
+			w.pending = append(w.pending, pendingDir{path: filepath.Join(dir.path, entry.Name), depth: dir.depth + 1})
+		}
+	}
+	return listing, nil
+}
+
+func (w *localWalker) Close() {
+	w.pending = nil
+}
+
+func (d *defaultServer) Walk(req *WalkRequest, stream GotService_WalkServer) error {
+	logCall(stream.Context(), "Walk")
+
+	dir := sessionFromContext(stream.Context()).Cwd()
+	if req.Dir != "" {
+		var err error
+		if dir, err = d.resolve(stream.Context(), req.Dir); err != nil {
+			return err
+		}
+	}
+	var limit = chunkLimit(d.config.MaxMessageSize)
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		limit = peerChunkLimit(limit, md.Get(maxMessageSizeKey))
+	}
+
+	// symlinks are not followed, the walk stays in the root
+	walker := WalkDir(dir, int(req.MaxDepth), req.All)
+	for {
+		listing, err := walker.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if listing.Err != nil {
+			if err = stream.Send(&WalkResponse{Dir: listing.Dir, Error: listing.Err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		// a large directory is listed over several messages
+		resp := &WalkResponse{Dir: listing.Dir}
+		size := proto.Size(resp)
+		for _, entry := range listing.Entries {
+			// the tag and length of an entry take at most 6 bytes
+			entrySize := proto.Size(entry) + 6
+			if len(resp.Entries) > 0 && size+entrySize > limit {
+				resp.More = true
+				if err = stream.Send(resp); err != nil {
+					return err
+				}
+				resp = &WalkResponse{Dir: listing.Dir}
+				size = proto.Size(resp)
+			}
+			resp.Entries = append(resp.Entries, entry)
+			size += entrySize
+		}
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Walk walks remote directory `dir`, the current one if empty, down to `maxDepth` levels,
+// all if 0. Entries starting with '.' are listed only if `all`.
+func (d *defaultClient) Walk(dir string, maxDepth int, all bool) (DirWalker, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := d.grpcClient.Walk(d.outgoingContext(ctx, nil),
+		&WalkRequest{Dir: dir, MaxDepth: int32(maxDepth), All: all})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	md, err := stream.Header()
+	if err == nil {
+		err = d.updateSession(md)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &remoteWalker{stream: stream, cancel: cancel}, nil
+}
+
+type remoteWalker struct {
+	stream GotService_WalkClient
+	cancel context.CancelFunc
+}
+
+func (w *remoteWalker) Next() (*DirListing, error) {
+	resp, err := w.stream.Recv()
+	if err != nil {
+		w.cancel()
+		return nil, err
+	}
+	listing := &DirListing{Dir: resp.Dir, Entries: resp.Entries}
+	if resp.Error != "" {
+		listing.Err = errors.New(resp.Error)
+	}
+	for resp.More {
+		if resp, err = w.stream.Recv(); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			w.cancel()
+			return nil, err
+		}
+		listing.Entries = append(listing.Entries, resp.Entries...)
+	}
+	return listing, nil
+}
+
+func (w *remoteWalker) Close() {
+	w.cancel()
+}
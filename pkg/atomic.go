@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// AtomicFile is written to a temporary file in the directory of its destination
+// and renamed to the destination on Commit, so readers never observe a half-written file.
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// CreateAtomic creates the temporary file of destination `path`, with permission `perm` once committed.
+func CreateAtomic(path string, perm os.FileMode) (*AtomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".got-*")
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Chmod(perm); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	return &AtomicFile{File: file, path: path}, nil
+}
+
+// Commit closes the temporary file and renames it to the destination.
+func (a *AtomicFile) Commit() error {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	if err := a.File.Close(); err != nil {
+		_ = os.Remove(a.File.Name())
+		return err
+	}
+	if err := os.Rename(a.File.Name(), a.path); err != nil {
+		_ = os.Remove(a.File.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file, it does nothing after Commit.
+func (a *AtomicFile) Abort() {
+	if a.done {
+		return
+	}
+	a.done = true
+	_ = a.File.Close()
+	_ = os.Remove(a.File.Name())
+}
+
+// MoveFile renames `src` to `dst` with permission `perm`, falling back to an atomic copy
+// when they are on different filesystems.
+func MoveFile(src string, dst string, perm os.FileMode) error {
+	if err := os.Chmod(src, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := CreateAtomic(dst, perm)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Abort()
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	if err = dstFile.Commit(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// MergeDir moves the content of directory `src` into the existing directory `dst`,
+// replacing files of the same name. A directory of `dst` which is a symlink or a file
+// is rejected as *UnTarError rather than written through.
+func MergeDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, name)
+		if !info.IsDir() {
+			return os.Rename(path, target)
+		}
+		existing, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			return os.Mkdir(target, info.Mode().Perm())
+		} else if err != nil {
+			return err
+		}
+		if !existing.IsDir() {
+			return &UnTarError{Name: filepath.ToSlash(name), Err: fmt.Errorf("%w: %s is not a directory",
+				ErrUnsafeEntry, target)}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// DefaultChecksumAlgorithm is the algorithm used when none is specified.
+const DefaultChecksumAlgorithm = "sha256"
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// ChecksumAlgorithms returns the names of supported checksum algorithms.
+func ChecksumAlgorithms() []string {
+	var names []string
+	for name := range checksumAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checksum is a running digest of transferred data, written to while streaming.
+type Checksum struct {
+	hash.Hash
+	algorithm string
+}
+
+// NewChecksum creates a checksum of `algorithm`, DefaultChecksumAlgorithm if empty.
+func NewChecksum(algorithm string) (*Checksum, error) {
+	if algorithm == "" {
+		algorithm = DefaultChecksumAlgorithm
+	}
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	return &Checksum{Hash: newHash(), algorithm: algorithm}, nil
+}
+
+// Algorithm returns the algorithm name of the checksum.
+func (c *Checksum) Algorithm() string {
+	return c.algorithm
+}
+
+// String returns the digest in the form of `<algorithm>:<hex>`.
+func (c *Checksum) String() string {
+	return c.algorithm + ":" + hex.EncodeToString(c.Sum(nil))
+}
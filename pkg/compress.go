@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Compression algorithms of transfers.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// maxDecoderWindow bounds the memory a zstd stream may make its decoder allocate, it is the
+// window of the encoder of NewCompressor.
+const maxDecoderWindow = 8 << 20
+
+// CompressionAlgorithms returns the names of supported compression algorithms, preferred first.
+func CompressionAlgorithms() []string {
+	return []string{Zstd, Gzip}
+}
+
+// NewCompressor returns a writer compressing to `w` with `algorithm`,
+// it must be closed to flush the compressed data.
+func NewCompressor(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %q", algorithm)
+}
+
+// NewDecompressor returns a reader of the data of `r` compressed with `algorithm`.
+func NewDecompressor(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(maxDecoderWindow), zstd.WithDecoderMaxMemory(maxDecoderWindow))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %q", algorithm)
+}
+
+// compressedExts are extensions of file types which hardly compress any further.
+var compressedExts = map[string]bool{
+	".7z": true, ".br": true, ".bz2": true, ".gz": true, ".tgz": true, ".lz4": true,
+	".lzma": true, ".rar": true, ".xz": true, ".zip": true, ".zst": true,
+	".jar": true, ".apk": true, ".deb": true, ".rpm": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".flac": true, ".opus": true,
+	".mp4": true, ".mkv": true, ".avi": true, ".mov": true, ".webm": true,
+	".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true,
+}
+
+// IsCompressed reports whether file `name` is of an already compressed type by its extension.
+func IsCompressed(name string) bool {
+	return compressedExts[strings.ToLower(filepath.Ext(name))]
+}
@@ -0,0 +1,396 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Delta transfer as rsync: the receiver of a file computes the signature of the blocks of
+// its existing copy, the sender matches the blocks at any offset of the new file by a
+// rolling weak checksum confirmed by a strong hash, and sends references to the matched
+// blocks and the data between them. The receiver rebuilds the new file from its copy.
+
+const (
+	// MinBlockSize and MaxBlockSize bound the block size of a signature
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 1 << 20
+	// MaxSignatureBlocks bounds the count of blocks of a signature
+	MaxSignatureBlocks = 1 << 21
+
+	strongSize = 16
+	// maxLiteral bounds the data of a delta instruction
+	maxLiteral = 256 << 10
+)
+
+// instructions of a delta stream
+const (
+	// opCopy is followed by the index of the first block and the count of blocks
+	opCopy byte = 'C'
+	// opData is followed by the length of the data and the data
+	opData byte = 'D'
+	// opEnd ends the delta
+	opEnd byte = 'E'
+)
+
+// ErrInvalidDelta is reported for a malformed delta or one not matching its base.
+var ErrInvalidDelta = errors.New("invalid delta")
+
+// BlockSignature is the weak checksum and strong hash of a block.
+type BlockSignature struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// Signature describes the blocks of a file, the last block may be shorter.
+type Signature struct {
+	BlockSize int
+	Blocks    []BlockSignature
+}
+
+// BlockSize returns the block size of the signature of a file of `size` bytes, about its
+// square root as rsync, large enough for at most MaxSignatureBlocks blocks.
+func BlockSize(size int64) int {
+	blockSize := int64(math.Sqrt(float64(size))) &^ 1023
+	if min := (size + MaxSignatureBlocks - 1) / MaxSignatureBlocks; blockSize < min {
+		blockSize = min
+	}
+	if blockSize < MinBlockSize {
+		return MinBlockSize
+	}
+	if blockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return int(blockSize)
+}
+
+// CheckBlockSize rejects a block size out of MinBlockSize and MaxBlockSize.
+func CheckBlockSize(blockSize int64) error {
+	if blockSize < MinBlockSize || blockSize > MaxBlockSize {
+		return fmt.Errorf("block size %d out of [%d, %d]", blockSize, MinBlockSize, MaxBlockSize)
+	}
+	return nil
+}
+
+// NewSignature computes the signature of the data of `r` in blocks of `blockSize`.
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	if err := CheckBlockSize(int64(blockSize)); err != nil {
+		return nil, err
+	}
+	signature := &Signature{BlockSize: blockSize}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			signature.Blocks = append(signature.Blocks, BlockSignature{
+				Weak:   weakSum(block[:n]).value(),
+				Strong: strongSum(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return signature, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(signature.Blocks) > MaxSignatureBlocks {
+			return nil, fmt.Errorf("more than %d blocks", MaxSignatureBlocks)
+		}
+	}
+}
+
+// rolling is the weak checksum of rsync, it rolls over the data a byte at a time.
+type rolling struct {
+	a, b uint32
+}
+
+func weakSum(p []byte) rolling {
+	var r rolling
+	l := uint32(len(p))
+	for i, x := range p {
+		r.a += uint32(x)
+		r.b += (l - uint32(i)) * uint32(x)
+	}
+	r.a &= 0xffff
+	r.b &= 0xffff
+	return r
+}
+
+// roll moves the window of `l` bytes on by one byte, `out` leaves and `in` enters it.
+func (r *rolling) roll(out byte, in byte, l int) {
+	r.a = (r.a - uint32(out) + uint32(in)) & 0xffff
+	r.b = (r.b - uint32(l)*uint32(out) + r.a) & 0xffff
+}
+
+func (r rolling) value() uint32 {
+	return r.a | r.b<<16
+}
+
+func strongSum(p []byte) []byte {
+	sum := sha256.Sum256(p)
+	return sum[:strongSize]
+}
+
+// deltaEncoder writes the instructions of a delta, consecutive blocks are merged.
+type deltaEncoder struct {
+	w         *bufio.Writer
+	copyStart int
+	copyCount int
+	varint    [binary.MaxVarintLen64]byte
+}
+
+func (e *deltaEncoder) uvarint(v uint64) error {
+	n := binary.PutUvarint(e.varint[:], v)
+	_, err := e.w.Write(e.varint[:n])
+	return err
+}
+
+func (e *deltaEncoder) copyBlock(index int) error {
+	if e.copyCount > 0 && e.copyStart+e.copyCount == index {
+		e.copyCount++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyStart, e.copyCount = index, 1
+	return nil
+}
+
+func (e *deltaEncoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+	if err := e.w.WriteByte(opCopy); err != nil {
+		return err
+	}
+	if err := e.uvarint(uint64(e.copyStart)); err != nil {
+		return err
+	}
+	err := e.uvarint(uint64(e.copyCount))
+	e.copyCount = 0
+	return err
+}
+
+// data writes `p` in instructions of at most maxLiteral bytes.
+func (e *deltaEncoder) data(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		if err := e.w.WriteByte(opData); err != nil {
+			return err
+		}
+		if err := e.uvarint(uint64(n)); err != nil {
+			return err
+		}
+		if _, err := e.w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (e *deltaEncoder) end() error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	if err := e.w.WriteByte(opEnd); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// WriteDelta writes the delta turning the file of `signature` into the data of `r` to `w`.
+func WriteDelta(signature *Signature, r io.Reader, w io.Writer) error {
+	blockSize := signature.BlockSize
+	if err := CheckBlockSize(int64(blockSize)); err != nil {
+		return err
+	}
+	index := make(map[uint32][]int, len(signature.Blocks))
+	for i, block := range signature.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+	// a shorter last block only matches the end of the data
+	var tail int
+	if n := len(signature.Blocks); n > 0 {
+		tail = n - 1
+	}
+	match := func(weak uint32, p []byte, allowTail bool) (int, bool) {
+		candidates := index[weak]
+		if candidates == nil {
+			return 0, false
+		}
+		strong := strongSum(p)
+		for _, i := range candidates {
+			if (len(p) == blockSize || (allowTail && i == tail)) && bytes.Equal(signature.Blocks[i].Strong, strong) {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	encoder := &deltaEncoder{w: bufio.NewWriterSize(w, 64<<10)}
+	flushAt := maxLiteral
+	if flushAt < blockSize {
+		flushAt = blockSize
+	}
+	// buf[:pos] is literal data not sent yet, buf[pos:pos+blockSize] is the window
+	buf := make([]byte, 0, flushAt+blockSize+1)
+	var pos int
+	var eof bool
+	fill := func() error {
+		for !eof && len(buf) < cap(buf) {
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var weak rolling
+	var rolled bool
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		if len(buf)-pos < blockSize {
+			break
+		}
+		window := buf[pos : pos+blockSize]
+		if !rolled {
+			weak = weakSum(window)
+			rolled = true
+		}
+		if i, ok := match(weak.value(), window, false); ok {
+			if err := encoder.data(buf[:pos]); err != nil {
+				return err
+			}
+			if err := encoder.copyBlock(i); err != nil {
+				return err
+			}
+			buf = buf[:copy(buf, buf[pos+blockSize:])]
+			pos, rolled = 0, false
+			continue
+		}
+		if len(buf)-pos == blockSize {
+			// the window is at the end of the data
+			break
+		}
+		weak.roll(buf[pos], buf[pos+blockSize], blockSize)
+		pos++
+		if pos >= flushAt {
+			if err := encoder.data(buf[:pos]); err != nil {
+				return err
+			}
+			buf = buf[:copy(buf, buf[pos:])]
+			pos = 0
+		}
+	}
+
+	// the rest is sent as data, except for an end matching a shorter last block
+	rest := buf
+	if len(signature.Blocks) > 0 {
+		if n := len(buf) - pos; n > 0 && n < blockSize {
+			end := buf[pos:]
+			if i, ok := match(weakSum(end).value(), end, true); ok {
+				if err := encoder.data(buf[:pos]); err != nil {
+					return err
+				}
+				if err := encoder.copyBlock(i); err != nil {
+					return err
+				}
+				rest = nil
+			}
+		}
+	}
+	if err := encoder.data(rest); err != nil {
+		return err
+	}
+	return encoder.end()
+}
+
+// ApplyDelta writes the file rebuilt from base file `base` of `size` bytes and the delta
+// read from `delta` to `w`, the delta is read up to its end. It returns the bytes written.
+func ApplyDelta(base io.ReaderAt, size int64, blockSize int, delta io.Reader, w io.Writer) (int64, error) {
+	if err := CheckBlockSize(int64(blockSize)); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(delta)
+	var written int64
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return written, fmt.Errorf("%w: unexpected end", ErrInvalidDelta)
+		} else if err != nil {
+			return written, err
+		}
+		switch op {
+		case opCopy:
+			start, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return written, truncatedDelta(err)
+			}
+			count, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return written, truncatedDelta(err)
+			}
+			// only the last block of the base may be shorter
+			offset := int64(start) * int64(blockSize)
+			length := int64(count) * int64(blockSize)
+			if start > MaxSignatureBlocks || count > MaxSignatureBlocks || count == 0 ||
+				offset+length-int64(blockSize) >= size {
+				return written, fmt.Errorf("%w: blocks %d+%d beyond the base", ErrInvalidDelta, start, count)
+			}
+			if offset+length > size {
+				length = size - offset
+			}
+			n, err := io.Copy(w, io.NewSectionReader(base, offset, length))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		case opData:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return written, truncatedDelta(err)
+			}
+			if length > maxLiteral {
+				return written, fmt.Errorf("%w: data of %d bytes", ErrInvalidDelta, length)
+			}
+			n, err := io.CopyN(w, reader, int64(length))
+			written += n
+			if err != nil {
+				return written, truncatedDelta(err)
+			}
+		case opEnd:
+			return written, nil
+		default:
+			return written, fmt.Errorf("%w: unknown instruction %q", ErrInvalidDelta, op)
+		}
+	}
+}
+
+// truncatedDelta reports the end of a delta within an instruction as ErrInvalidDelta.
+func truncatedDelta(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: unexpected end", ErrInvalidDelta)
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// roundTrip rebuilds `data` from `base` by a delta, it returns the delta.
+func roundTrip(t *testing.T, base []byte, data []byte) []byte {
+	t.Helper()
+	signature, err := NewSignature(bytes.NewReader(base), MinBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delta bytes.Buffer
+	if err = WriteDelta(signature, bytes.NewReader(data), &delta); err != nil {
+		t.Fatal(err)
+	}
+	encoded := append([]byte(nil), delta.Bytes()...)
+	var out bytes.Buffer
+	n, err := ApplyDelta(bytes.NewReader(base), int64(len(base)), MinBlockSize, &delta, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("rebuilt %d bytes differing from the %d bytes of the data", n, len(data))
+	}
+	return encoded
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := randomData(1, 10*MinBlockSize+123)
+	tests := []struct {
+		name string
+		base []byte
+		data []byte
+		// maxDelta bounds the size of the delta, unbounded if 0
+		maxDelta int
+	}{
+		{name: "empty", base: nil, data: nil},
+		{name: "empty base", base: nil, data: base},
+		{name: "empty data", base: base, data: nil, maxDelta: 1},
+		{name: "identical", base: base, data: base, maxDelta: 16},
+		{name: "shifted", base: base, data: append([]byte("inserted"), base...), maxDelta: 64},
+		// the shorter last block of the base is no longer at the end, it is sent as data
+		{name: "appended", base: base, data: append(append([]byte(nil), base...), randomData(2, 1000)...),
+			maxDelta: 1000 + 123 + 64},
+		{name: "truncated", base: base, data: base[:5*MinBlockSize+7], maxDelta: 64},
+		{name: "middle changed", base: base, data: append(append(append([]byte(nil), base[:3*MinBlockSize]...),
+			randomData(3, 100)...), base[3*MinBlockSize+100:]...), maxDelta: 2*MinBlockSize + 64},
+		{name: "different", base: base, data: randomData(4, 3*MinBlockSize)},
+		{name: "larger than a data instruction", base: nil, data: randomData(5, 3*maxLiteral+1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delta := roundTrip(t, test.base, test.data)
+			if test.maxDelta > 0 && len(delta) > test.maxDelta {
+				t.Fatalf("delta of %d bytes, expect at most %d", len(delta), test.maxDelta)
+			}
+		})
+	}
+}
+
+// instruction encodes a delta instruction of `op` followed by the varints of `args`.
+func instruction(op byte, args ...uint64) []byte {
+	b := []byte{op}
+	for _, arg := range args {
+		var buf [binary.MaxVarintLen64]byte
+		b = append(b, buf[:binary.PutUvarint(buf[:], arg)]...)
+	}
+	return b
+}
+
+func TestApplyDeltaRejects(t *testing.T) {
+	base := randomData(1, 4*MinBlockSize)
+	var valid bytes.Buffer
+	signature, err := NewSignature(bytes.NewReader(base), MinBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(append([]byte("x"), base...), "tail"...)
+	if err = WriteDelta(signature, bytes.NewReader(data), &valid); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{name: "empty", delta: nil},
+		{name: "no end", delta: valid.Bytes()[:valid.Len()-1]},
+		{name: "truncated", delta: valid.Bytes()[:valid.Len()/2]},
+		{name: "truncated instruction", delta: instruction(opCopy)},
+		{name: "truncated data", delta: append(instruction(opData, 10), "short"...)},
+		{name: "unknown instruction", delta: instruction('X')},
+		{name: "copy beyond the base", delta: append(instruction(opCopy, 4, 1), opEnd)},
+		{name: "copy running past the base", delta: append(instruction(opCopy, 2, 3), opEnd)},
+		{name: "copy of too many blocks", delta: append(instruction(opCopy, 0, MaxSignatureBlocks+1), opEnd)},
+		{name: "data too large", delta: append(instruction(opData, maxLiteral+1), opEnd)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ApplyDelta(bytes.NewReader(base), int64(len(base)), MinBlockSize,
+				bytes.NewReader(test.delta), &bytes.Buffer{})
+			if !errors.Is(err, ErrInvalidDelta) {
+				t.Fatalf("ApplyDelta = %v, want %v", err, ErrInvalidDelta)
+			}
+		})
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	for _, blockSize := range []int{0, MinBlockSize - 1, MaxBlockSize + 1} {
+		if _, err := NewSignature(bytes.NewReader(nil), blockSize); err == nil {
+			t.Errorf("NewSignature accepts block size %d", blockSize)
+		}
+		_, err := ApplyDelta(bytes.NewReader(nil), 0, blockSize, bytes.NewReader([]byte{opEnd}), &bytes.Buffer{})
+		if err == nil {
+			t.Errorf("ApplyDelta accepts block size %d", blockSize)
+		}
+	}
+	for _, size := range []int64{0, 1 << 20, 1 << 30, 1 << 40} {
+		if err := CheckBlockSize(int64(BlockSize(size))); err != nil {
+			t.Errorf("BlockSize(%d): %v", size, err)
+		}
+	}
+}
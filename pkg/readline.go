@@ -0,0 +1,310 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// MaxHistory bounds the lines kept in the history of a LineReader.
+const MaxHistory = 1000
+
+// LineReader reads the lines typed on a terminal with line editing, history and tab
+// completion. The lines of a file or pipe are read as they are, without a prompt.
+type LineReader struct {
+	// Complete returns the completions of `word`, the word before the cursor of `line`
+	// which ends at the cursor. A completion ending with '/' is not followed by a space.
+	Complete func(line string, word string) []string
+
+	in       *os.File
+	out      io.Writer
+	reader   *bufio.Reader
+	terminal bool
+	history  []string
+}
+
+// NewLineReader returns a reader of the lines of `in`, echoed to `out` if typed on a terminal.
+func NewLineReader(in *os.File, out io.Writer) *LineReader {
+	return &LineReader{
+		in:       in,
+		out:      out,
+		reader:   bufio.NewReader(in),
+		terminal: isTerminal(int(in.Fd())),
+	}
+}
+
+// Terminal reports whether the lines are typed on a terminal.
+func (l *LineReader) Terminal() bool {
+	return l.terminal
+}
+
+// AddHistory appends `line` to the history, unless it repeats the last line.
+func (l *LineReader) AddHistory(line string) {
+	if line == "" || (len(l.history) > 0 && l.history[len(l.history)-1] == line) {
+		return
+	}
+	l.history = append(l.history, line)
+	if len(l.history) > MaxHistory {
+		l.history = l.history[len(l.history)-MaxHistory:]
+	}
+}
+
+// LoadHistory appends the lines of history file `path` to the history, a missing file is
+// no error.
+func (l *LineReader) LoadHistory(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		l.AddHistory(line)
+	}
+	return nil
+}
+
+// SaveHistory writes the history to file `path`, readable only by the user.
+func (l *LineReader) SaveHistory(path string) error {
+	file, err := CreateAtomic(path, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+	for _, line := range l.history {
+		if _, err = fmt.Fprintln(file, line); err != nil {
+			return err
+		}
+	}
+	return file.Commit()
+}
+
+// ReadLine prints `prompt` and returns the line typed, without its end. It returns io.EOF
+// at the end of the input, and for Ctrl-D on an empty line of a terminal.
+func (l *LineReader) ReadLine(prompt string) (string, error) {
+	if !l.terminal {
+		line, err := l.reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	restore, err := makeRaw(int(l.in.Fd()))
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	return l.edit(prompt)
+}
+
+func ctrl(r rune) rune {
+	return r & 0x1f
+}
+
+// lineEditor is the state of a line being edited.
+type lineEditor struct {
+	*LineReader
+	prompt string
+	line   []rune
+	pos    int
+	// index is the line of the history shown, len(history) for the line being edited
+	index  int
+	edited []rune
+}
+
+func (l *LineReader) edit(prompt string) (string, error) {
+	e := &lineEditor{LineReader: l, prompt: prompt, index: len(l.history)}
+	fmt.Fprint(l.out, prompt)
+	for {
+		r, _, err := l.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(l.out, "\r\n")
+			return string(e.line), nil
+		case ctrl('C'):
+			fmt.Fprint(l.out, "^C\r\n")
+			e.line, e.pos, e.index = nil, 0, len(l.history)
+		case ctrl('D'):
+			if len(e.line) == 0 {
+				fmt.Fprint(l.out, "\r\n")
+				return "", io.EOF
+			}
+			e.deleteRunes(e.pos, e.pos+1)
+		case 127, ctrl('H'):
+			e.deleteRunes(e.pos-1, e.pos)
+		case ctrl('A'):
+			e.pos = 0
+		case ctrl('E'):
+			e.pos = len(e.line)
+		case ctrl('B'):
+			e.move(-1)
+		case ctrl('F'):
+			e.move(1)
+		case ctrl('K'):
+			e.line = e.line[:e.pos]
+		case ctrl('U'):
+			e.deleteRunes(0, e.pos)
+		case ctrl('W'):
+			start := e.pos
+			for start > 0 && e.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && e.line[start-1] != ' ' {
+				start--
+			}
+			e.deleteRunes(start, e.pos)
+		case ctrl('L'):
+			fmt.Fprint(l.out, "\x1b[H\x1b[2J")
+		case ctrl('P'):
+			e.browse(-1)
+		case ctrl('N'):
+			e.browse(1)
+		case '\t':
+			e.complete()
+		case 27:
+			if err = e.escape(); err != nil {
+				return "", err
+			}
+		default:
+			if unicode.IsPrint(r) {
+				e.line = append(e.line[:e.pos], append([]rune{r}, e.line[e.pos:]...)...)
+				e.pos++
+			}
+		}
+		e.redraw()
+	}
+}
+
+// escape handles the escape sequences of the arrow, home, end and delete keys.
+func (e *lineEditor) escape() error {
+	r, _, err := e.reader.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return err
+	}
+	var param []rune
+	for {
+		if r, _, err = e.reader.ReadRune(); err != nil {
+			return err
+		}
+		if r < '0' || r > '9' {
+			break
+		}
+		param = append(param, r)
+	}
+	switch {
+	case r == 'A':
+		e.browse(-1)
+	case r == 'B':
+		e.browse(1)
+	case r == 'C':
+		e.move(1)
+	case r == 'D':
+		e.move(-1)
+	case r == 'H' || (r == '~' && (string(param) == "1" || string(param) == "7")):
+		e.pos = 0
+	case r == 'F' || (r == '~' && (string(param) == "4" || string(param) == "8")):
+		e.pos = len(e.line)
+	case r == '~' && string(param) == "3":
+		e.deleteRunes(e.pos, e.pos+1)
+	}
+	return nil
+}
+
+func (e *lineEditor) move(n int) {
+	if pos := e.pos + n; pos >= 0 && pos <= len(e.line) {
+		e.pos = pos
+	}
+}
+
+// deleteRunes deletes line[start:end], bounded by the line.
+func (e *lineEditor) deleteRunes(start int, end int) {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(e.line) {
+		end = len(e.line)
+	}
+	if start >= end {
+		return
+	}
+	e.line = append(e.line[:start], e.line[end:]...)
+	if e.pos > end {
+		e.pos -= end - start
+	} else if e.pos > start {
+		e.pos = start
+	}
+}
+
+// browse shows the line `n` lines later in the history.
+func (e *lineEditor) browse(n int) {
+	index := e.index + n
+	if index < 0 || index > len(e.history) {
+		return
+	}
+	if e.index == len(e.history) {
+		e.edited = append([]rune(nil), e.line...)
+	}
+	e.index = index
+	if index == len(e.history) {
+		e.line = e.edited
+	} else {
+		e.line = []rune(e.history[index])
+	}
+	e.pos = len(e.line)
+}
+
+// complete completes the word before the cursor to the longest common prefix of its
+// completions, the completions are listed if it is already complete.
+func (e *lineEditor) complete() {
+	if e.Complete == nil {
+		return
+	}
+	start := e.pos
+	for start > 0 && e.line[start-1] != ' ' {
+		start--
+	}
+	word := string(e.line[start:e.pos])
+	completions := e.Complete(string(e.line[:e.pos]), word)
+	if len(completions) == 0 {
+		return
+	}
+	prefix := []rune(completions[0])
+	for _, c := range completions[1:] {
+		runes := []rune(c)
+		n := 0
+		for n < len(prefix) && n < len(runes) && prefix[n] == runes[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if len(completions) == 1 && !strings.HasSuffix(completions[0], "/") {
+		prefix = append(prefix, ' ')
+	}
+	if len(prefix) > e.pos-start {
+		rest := append([]rune(nil), e.line[e.pos:]...)
+		e.line = append(append(e.line[:start], prefix...), rest...)
+		e.pos = start + len(prefix)
+		return
+	}
+	if len(completions) > 1 {
+		// completions are listed by their last component as shells do
+		names := make([]string, len(completions))
+		for i, c := range completions {
+			names[i] = c[strings.LastIndex(strings.TrimSuffix(c, "/"), "/")+1:]
+		}
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(names, "  "))
+	}
+}
+
+func (e *lineEditor) redraw() {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", e.prompt, string(e.line))
+	if n := len(e.line) - e.pos; n > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", n)
+	}
+}
@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a byte size like `512`, `64K`, `4M` or `1G`, units are powers of 1024
+// and may be followed by `iB` or `B`.
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str, unit = strings.TrimSuffix(str, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+// FormatSize formats `size` bytes with the largest unit it is a multiple of.
+func FormatSize(size int64) string {
+	for _, u := range sizeUnits {
+		if size != 0 && size%u.size == 0 {
+			return strconv.FormatInt(size/u.size, 10) + strings.TrimSuffix(u.suffix, "B")
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+// HumanSize formats `size` bytes rounded to the largest unit not above it as ls -h,
+// with a decimal below 10 like `1.5M`.
+func HumanSize(size int64) string {
+	for _, u := range sizeUnits[:len(sizeUnits)-1] {
+		if size >= u.size {
+			v := float64(size) / float64(u.size)
+			if v < 10 {
+				return strconv.FormatFloat(v, 'f', 1, 64) + u.suffix
+			}
+			return strconv.FormatFloat(v, 'f', 0, 64) + u.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
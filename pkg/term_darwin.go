@@ -0,0 +1,8 @@
+package pkg
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const ioctlGetTermios = unix.TIOCGETA
+const ioctlSetTermios = unix.TIOCSETA
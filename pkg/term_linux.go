@@ -0,0 +1,8 @@
+package pkg
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const ioctlGetTermios = unix.TCGETS
+const ioctlSetTermios = unix.TCSETS
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package pkg
+
+import (
+	"errors"
+)
+
+// terminals are read as files where raw mode is not supported
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw mode is not supported")
+}
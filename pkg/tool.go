@@ -15,90 +15,400 @@ import (
 // Tar is called for zip up file or directory.
 // `src` is source of file for tar zip, `dst` is the save path of tar file.
 func Tar(src string, dst string) error {
-	var err error
-	tarFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+	tarFile, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-	defer tarFile.Close()
+	if err = TarTo(src, tarFile); err != nil {
+		_ = tarFile.Close()
+		return err
+	}
+	return tarFile.Close()
+}
+
+// TarTo writes the tar stream of file or directory `src` to `w`.
+// Entries are named relative to the parent directory of `src`, so the archive
+// always unpacks as the base name of `src`.
+func TarTo(src string, w io.Writer) error {
+	listing, err := ListTar(src)
+	if err != nil {
+		return err
+	}
+	_, err = listing.WriteTo(w)
+	return err
+}
 
-	tarWriter := tar.NewWriter(tarFile)
-	defer tarWriter.Close()
+// TarSize returns the size of the stream TarTo writes for `src`, without reading the files.
+func TarSize(src string) (int64, error) {
+	listing, err := ListTar(src)
+	if err != nil {
+		return 0, err
+	}
+	return listing.Size, nil
+}
+
+// TarListing is the listing of file or directory `src` a tar stream is written from,
+// the stream is of exactly `Size` bytes whatever the files become after the listing.
+type TarListing struct {
+	Size    int64
+	entries []tarEntry
+}
+
+type tarEntry struct {
+	path   string
+	header *tar.Header
+}
 
-	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-		header, err := tar.FileInfoHeader(info, "")
+// ListTar lists file or directory `src` for its tar stream, as TarTo names the entries.
+func ListTar(src string) (*TarListing, error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	// the stream ends with two zero blocks
+	listing := &TarListing{Size: 2 * tarBlockSize}
+	base := filepath.Dir(src)
+	err = filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		header.Name = filepath.ToSlash(path)
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			file, err := os.OpenFile(path, os.O_RDONLY, 0644)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(tarWriter, file); err != nil {
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
 				return err
 			}
 		}
-		return err
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		// a header takes several blocks for long names, the content is padded to a block
+		counter := &countWriter{}
+		if err := tar.NewWriter(counter).WriteHeader(header); err != nil {
+			return err
+		}
+		listing.Size += counter.n + (header.Size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+		listing.entries = append(listing.entries, tarEntry{path: path, header: header})
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
+
+// WriteTo writes the tar stream of the listing to `w`. A file is written of its listed
+// size even if it grows meanwhile, a file shrunk or removed fails the stream.
+func (l *TarListing) WriteTo(w io.Writer) (int64, error) {
+	counter := &countWriter{w: w}
+	tarWriter := tar.NewWriter(counter)
+	for _, entry := range l.entries {
+		if err := tarWriter.WriteHeader(entry.header); err != nil {
+			return counter.n, err
+		}
+		if entry.header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := copyFileN(tarWriter, entry.path, entry.header.Size); err != nil {
+			return counter.n, err
+		}
+	}
+	err := tarWriter.Close()
+	return counter.n, err
+}
+
+// copyFileN copies the first `size` bytes of file `path` to `w`.
+func copyFileN(w io.Writer, path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(w, file, size)
+	return err
+}
+
+// tarBlockSize is the size of a tar block.
+const tarBlockSize = 512
+
+// countWriter counts the bytes written to `w`, which may be nil.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	var err error
+	if c.w != nil {
+		n, err = c.w.Write(p)
+	}
+	c.n += int64(n)
+	return n, err
+}
+
+// ErrUnsafeEntry is reported for tar entries which could write out of the destination.
+var ErrUnsafeEntry = errors.New("unsafe tar entry")
+
+// ErrLimitExceeded is reported when a tar archive exceeds the extraction limits.
+var ErrLimitExceeded = errors.New("tar limit exceeded")
+
+// UnTarError is the error of rejecting a tar entry, `Err` wraps
+// `ErrUnsafeEntry` or `ErrLimitExceeded`.
+type UnTarError struct {
+	Name string
+	Err  error
+}
+
+func (e *UnTarError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
 }
 
-// UnTar is called for unzip tar file.
+func (e *UnTarError) Unwrap() error {
+	return e.Err
+}
+
+// UnTarLimits bounds the extraction of a tar archive, zero value of a field means no limit.
+type UnTarLimits struct {
+	// MaxBytes is the total size of all entries
+	MaxBytes int64
+	// MaxEntries is the number of entries
+	MaxEntries int
+	// MaxDepth is the number of path components of an entry
+	MaxDepth int
+}
+
+// DefaultUnTarLimits is the limits used by UnTar.
+var DefaultUnTarLimits = UnTarLimits{
+	MaxBytes:   16 << 30,
+	MaxEntries: 1 << 20,
+	MaxDepth:   64,
+}
+
+// UnTar is called for unzip tar file with DefaultUnTarLimits.
 // `src` is tar file path, `dst` is target path for unzip.
 func UnTar(src string, dst string) error {
-	var err error
+	return UnTarWithLimits(src, dst, DefaultUnTarLimits)
+}
 
+// UnTarWithLimits is called for unzip tar file in hardened mode: entries escaping `dst`,
+// device and FIFO entries, hard links and symlinks pointing out of `dst` are rejected,
+// and the archive must be within `limits`. Rejections are reported as *UnTarError.
+func UnTarWithLimits(src string, dst string, limits UnTarLimits) error {
 	tarFile, err := os.OpenFile(src, os.O_RDONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer tarFile.Close()
+	return UnTarFrom(tarFile, dst, limits)
+}
+
+// UnTarFrom extracts the tar stream read from `r` into directory `dst`, it reads
+// the stream up to the end of the archive. Entries are checked as by UnTarWithLimits.
+func UnTarFrom(r io.Reader, dst string, limits UnTarLimits) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
 
-	tarReader := tar.NewReader(tarFile)
+	var totalBytes int64
+	var entries int
+	tarReader := tar.NewReader(r)
 	for header, err := tarReader.Next(); err != io.EOF; header, err = tarReader.Next() {
 		if err != nil {
 			return err
 		}
+
+		// check limits
+		entries++
+		totalBytes += header.Size
+		if limits.MaxEntries > 0 && entries > limits.MaxEntries {
+			return &UnTarError{Name: header.Name, Err: fmt.Errorf("%w: more than %d entries",
+				ErrLimitExceeded, limits.MaxEntries)}
+		}
+		if limits.MaxBytes > 0 && totalBytes > limits.MaxBytes {
+			return &UnTarError{Name: header.Name, Err: fmt.Errorf("%w: more than %d bytes",
+				ErrLimitExceeded, limits.MaxBytes)}
+		}
+
+		path, err := EntryPath(dst, header.Name, limits.MaxDepth)
+		if err != nil {
+			return err
+		}
+
 		info := header.FileInfo()
-		path := filepath.Join(dst, header.Name)
-		if header.Typeflag == tar.TypeDir {
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// the mode would be set on the target of a symlink
+			if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return &UnTarError{Name: header.Name, Err: fmt.Errorf("%w: directory is a symlink",
+					ErrUnsafeEntry)}
+			}
 			_ = os.MkdirAll(path, os.ModeDir|0755)
 			_ = os.Chmod(path, os.ModeDir|0755)
-		} else {
+		case tar.TypeReg, tar.TypeRegA:
 			_ = os.MkdirAll(filepath.Dir(path), os.ModeDir|0755)
-			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+			// written atomically, an existing symlink is replaced rather than written through
+			file, err := CreateAtomic(path, info.Mode().Perm())
 			if err != nil {
 				return err
 			}
 			if _, err = io.Copy(file, tarReader); err != nil {
+				file.Abort()
+				return err
+			}
+			if err = file.Commit(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err = CheckSymlink(dst, path, header.Name, header.Linkname); err != nil {
 				return err
 			}
-			_ = file.Close()
-			_ = os.Chmod(path, info.Mode().Perm())
+			_ = os.MkdirAll(filepath.Dir(path), os.ModeDir|0755)
+			_ = os.Remove(path)
+			if err = os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return &UnTarError{Name: header.Name, Err: fmt.Errorf("%w: type %q not allowed",
+				ErrUnsafeEntry, header.Typeflag)}
 		}
 	}
 	return err
 }
 
+// EntryPath returns the extraction path of entry `name` in `dst`, `name` is slash separated.
+// The path must stay in `dst` and must not pass through a symlink.
+func EntryPath(dst string, name string, maxDepth int) (string, error) {
+	path, err := CleanEntryPath(dst, name, maxDepth)
+	if err != nil {
+		return "", err
+	}
+	for dir := filepath.Dir(path); within(dst, dir) && dir != dst; dir = filepath.Dir(dir) {
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", &UnTarError{Name: name, Err: fmt.Errorf("%w: path passes through symlink %s",
+				ErrUnsafeEntry, dir)}
+		}
+	}
+	return path, nil
+}
+
+// CleanEntryPath returns the extraction path of entry `name` in `dst` as EntryPath by the
+// name alone, the symlinks in `dst` are not looked at. Entries are checked so before any
+// change to `dst`, and by EntryPath once they are extracted.
+func CleanEntryPath(dst string, name string, maxDepth int) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || !within(dst, filepath.Join(dst, clean)) {
+		return "", &UnTarError{Name: name, Err: fmt.Errorf("%w: path escapes destination", ErrUnsafeEntry)}
+	}
+	if depth := len(strings.Split(clean, string(filepath.Separator))); maxDepth > 0 && depth > maxDepth {
+		return "", &UnTarError{Name: name, Err: fmt.Errorf("%w: deeper than %d", ErrLimitExceeded, maxDepth)}
+	}
+	return filepath.Join(dst, clean), nil
+}
+
+// CheckSymlink rejects symlink entry `name` at `path` in `dst` if its target `link`
+// is absolute or points out of `dst`. The target may go up only before its first name,
+// as `../lib/x`: `b/..` is wherever `b` leads once it is replaced, by a symlink of a
+// later entry as well. The symlinks the target passes through must stay in `dst`.
+func CheckSymlink(dst string, path string, name string, link string) error {
+	return checkSymlink(dst, path, name, link, true)
+}
+
+// CheckSymlinkTarget rejects symlink entry `name` as CheckSymlink by its target alone, the
+// symlinks in `dst` are not followed.
+func CheckSymlinkTarget(dst string, path string, name string, link string) error {
+	return checkSymlink(dst, path, name, link, false)
+}
+
+func checkSymlink(dst string, path string, name string, link string, followExisting bool) error {
+	escapes := &UnTarError{Name: name, Err: fmt.Errorf("%w: symlink to %s escapes destination",
+		ErrUnsafeEntry, link)}
+	if filepath.IsAbs(link) {
+		return escapes
+	}
+	realDst, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		realDst = dst
+	}
+
+	target := filepath.Dir(path)
+	named := false
+	for _, part := range strings.Split(filepath.FromSlash(link), string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if named {
+				return &UnTarError{Name: name, Err: fmt.Errorf("%w: symlink to %s goes up after a name",
+					ErrUnsafeEntry, link)}
+			}
+			target = filepath.Dir(target)
+		default:
+			named = true
+			target = filepath.Join(target, part)
+		}
+		if !within(dst, target) {
+			return escapes
+		}
+		// symlinks already in dst are followed as they resolve now
+		if !followExisting {
+			continue
+		}
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			real, err := filepath.EvalSymlinks(target)
+			if err != nil || !within(realDst, real) {
+				return escapes
+			}
+		}
+	}
+	return nil
+}
+
+// within reports whether `path` is `dir` or inside `dir`.
+func within(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// ProcessBar shows the progress from `start` to `end` of the sizes pushed to `push` until `ctx`
+// is done. The returned channel is closed when the bar ends. A negative `end` is a total
+// unknown, the bar then shows the size pushed and ends when `push` is closed.
 func ProcessBar(tag string, start int64, end int64, push <-chan int64, ctx context.Context) (<-chan struct{}, error) {
-	if end < start || push == nil {
+	if (end >= 0 && end < start) || push == nil {
 		return nil, errors.New("invalid argument")
 	}
 	var processCh = make(chan struct{})
+	if end < 0 {
+		go countBar(tag, start, push, ctx, processCh)
+		return processCh, nil
+	}
 	go func(int64, int64, <-chan struct{}) {
 		var barLen = 16
 		var totalProgress = end - start
 		var stepProgress = totalProgress
 		var currentStepProgress = stepProgress
 
-		fmt.Printf("\r%-12s%-12s: [%s]", tag, "processing", strings.Repeat("-", barLen))
-		for i := 0; i < barLen; {
+		if totalProgress > 0 {
+			fmt.Printf("\r%-12s%-12s: [%s]", tag, "processing", strings.Repeat("-", barLen))
+		}
+		for i := 0; totalProgress > 0 && i < barLen; {
 			select {
-			case progress := <-push:
+			case progress, ok := <-push:
+				if !ok {
+					// the progress ended before the end
+					fmt.Printf("\r%-12s%-12s: [%s]\n", tag, "abort", strings.Repeat("█", i))
+					close(processCh)
+					return
+				}
 				currentStepProgress -= progress * int64(barLen)
 				for ; currentStepProgress <= 0 && i < barLen; currentStepProgress += stepProgress {
 					fmt.Printf("\r%-12s%-12s: [%s%s]", tag, "processing", strings.Repeat("█", i),
@@ -107,13 +417,50 @@ func ProcessBar(tag string, start int64, end int64, push <-chan int64, ctx conte
 				}
 			case <-ctx.Done():
 				fmt.Printf("\r%-12s%-12s: [%s]\n", tag, "abort", strings.Repeat("█", i))
-				processCh <- struct{}{}
+				close(processCh)
 				return
 			}
 		}
 		fmt.Printf("\r%-12s%-12s: [%s]", tag, "finish", strings.Repeat("█", barLen))
-		processCh <- struct{}{}
 		close(processCh)
+
+		// progress beyond the end is drained, so pushing never blocks
+		for {
+			select {
+			case _, ok := <-push:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
 	}(start, end, processCh)
 	return processCh, nil
 }
+
+// countBar shows the size pushed to `push` from `start` for a progress of unknown total, it
+// closes `processCh` when `push` is closed or `ctx` is done.
+func countBar(tag string, start int64, push <-chan int64, ctx context.Context, processCh chan<- struct{}) {
+	defer close(processCh)
+	var count = start
+	var shown string
+	for {
+		select {
+		case progress, ok := <-push:
+			if !ok {
+				fmt.Printf("\r%-12s%-12s: %-8s", tag, "finish", HumanSize(count))
+				return
+			}
+			count += progress
+			// the size is printed as it changes
+			if size := HumanSize(count); size != shown {
+				fmt.Printf("\r%-12s%-12s: %-8s", tag, "processing", size)
+				shown = size
+			}
+		case <-ctx.Done():
+			fmt.Printf("\r%-12s%-12s: %-8s\n", tag, "abort", HumanSize(count))
+			return
+		}
+	}
+}
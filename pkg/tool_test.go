@@ -0,0 +1,416 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// entry is a tar entry of a test archive, a regular file unless `typ` is set.
+type entry struct {
+	name string
+	typ  byte
+	link string
+	data string
+}
+
+func tarOf(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.link, Mode: 0644}
+		switch e.typ {
+		case 0:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(e.data))
+		case tar.TypeDir:
+			header.Mode = 0755
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// symlink creates symlink `name` to `target`, the test is skipped without symlinks.
+func symlink(t *testing.T, target string, name string) {
+	t.Helper()
+	if err := os.Symlink(target, name); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+}
+
+func TestListTar(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	long := strings.Repeat("n", 150)
+	files := map[string]string{
+		"empty":            "",
+		"block":            strings.Repeat("b", 512),
+		"d/odd":            strings.Repeat("o", 513),
+		"d/" + long + "/f": "long name",
+	}
+	for name, data := range files {
+		name = filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink(t, "d/odd", filepath.Join(src, "s"))
+
+	listing, err := ListTar(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file grown after the listing is cut at its listed size
+	grown := filepath.Join(src, "block")
+	if err := os.WriteFile(grown, []byte(strings.Repeat("g", 2048)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err := listing.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != listing.Size || int64(buf.Len()) != listing.Size {
+		t.Fatalf("listing of %d bytes wrote %d, %d", listing.Size, n, buf.Len())
+	}
+	files["block"] = strings.Repeat("g", 512)
+
+	r := tar.NewReader(&buf)
+	var read int
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := files[strings.TrimPrefix(header.Name, "src/")]; string(data) != want {
+			t.Errorf("%s is %q, want %q", header.Name, data, want)
+		}
+		read++
+	}
+	if read != len(files) {
+		t.Errorf("%d files read, want %d", read, len(files))
+	}
+
+	// a file shrunk after the listing fails the stream instead of changing its size
+	if err := os.WriteFile(grown, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listing.WriteTo(io.Discard); err == nil {
+		t.Error("a shrunk file is written")
+	}
+}
+
+func TestUnTarFrom(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "dst")
+	archive := tarOf(t,
+		entry{name: "d/", typ: tar.TypeDir},
+		entry{name: "d/f", data: "hello"},
+		entry{name: "d/e/g", data: "deep"},
+		entry{name: "l", typ: tar.TypeSymlink, link: "d/f"},
+		entry{name: "d/up", typ: tar.TypeSymlink, link: "../l"},
+	)
+	if err := UnTarFrom(archive, dst, DefaultUnTarLimits); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"d/f": "hello", "d/e/g": "deep", "l": "hello", "d/up": "hello"} {
+		data, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestUnTarFromRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+		limits  UnTarLimits
+		want    error
+	}{
+		{name: "dot dot", entries: []entry{{name: "../x", data: "x"}}, want: ErrUnsafeEntry},
+		{name: "dot dot inside", entries: []entry{{name: "a/../../x", data: "x"}}, want: ErrUnsafeEntry},
+		{name: "absolute", entries: []entry{{name: "/tmp/x", data: "x"}}, want: ErrUnsafeEntry},
+		{name: "hard link", entries: []entry{{name: "f", data: "x"}, {name: "h", typ: tar.TypeLink, link: "f"}},
+			want: ErrUnsafeEntry},
+		{name: "char device", entries: []entry{{name: "c", typ: tar.TypeChar}}, want: ErrUnsafeEntry},
+		{name: "block device", entries: []entry{{name: "b", typ: tar.TypeBlock}}, want: ErrUnsafeEntry},
+		{name: "fifo", entries: []entry{{name: "p", typ: tar.TypeFifo}}, want: ErrUnsafeEntry},
+		{name: "absolute symlink", entries: []entry{{name: "s", typ: tar.TypeSymlink, link: "/etc"}},
+			want: ErrUnsafeEntry},
+		{name: "symlink out", entries: []entry{{name: "a/s", typ: tar.TypeSymlink, link: "../../x"}},
+			want: ErrUnsafeEntry},
+		{name: "file through symlink", entries: []entry{
+			{name: "d/", typ: tar.TypeDir},
+			{name: "s", typ: tar.TypeSymlink, link: "d"},
+			{name: "s/f", data: "x"},
+		}, want: ErrUnsafeEntry},
+		{name: "chained symlinks", entries: []entry{
+			{name: "b", typ: tar.TypeSymlink, link: "."},
+			{name: "c", typ: tar.TypeSymlink, link: "b/.."},
+		}, want: ErrUnsafeEntry},
+		{name: "symlink going up after a directory replaced later", entries: []entry{
+			{name: "a/b/", typ: tar.TypeDir},
+			{name: "a/c", typ: tar.TypeSymlink, link: "b/../.."},
+			{name: "a/b", typ: tar.TypeSymlink, link: ".."},
+		}, want: ErrUnsafeEntry},
+		{name: "directory over symlink", entries: []entry{
+			{name: "s", typ: tar.TypeSymlink, link: "."},
+			{name: "s/", typ: tar.TypeDir},
+		}, want: ErrUnsafeEntry},
+		{name: "max entries", entries: []entry{{name: "a", data: "x"}, {name: "b", data: "x"}},
+			limits: UnTarLimits{MaxEntries: 1}, want: ErrLimitExceeded},
+		{name: "max bytes", entries: []entry{{name: "a", data: "abc"}, {name: "b", data: "def"}},
+			limits: UnTarLimits{MaxBytes: 5}, want: ErrLimitExceeded},
+		{name: "max depth", entries: []entry{{name: "a/b/c", data: "x"}},
+			limits: UnTarLimits{MaxDepth: 2}, want: ErrLimitExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+			dst := filepath.Join(base, "dst")
+			if err := os.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := UnTarFrom(tarOf(t, test.entries...), dst, test.limits)
+			var untarErr *UnTarError
+			if !errors.Is(err, test.want) || !errors.As(err, &untarErr) {
+				t.Fatalf("UnTarFrom = %v, want %v", err, test.want)
+			}
+			if _, err := os.Lstat(filepath.Join(base, "x")); err == nil {
+				t.Fatal("an entry was written out of the destination")
+			}
+		})
+	}
+}
+
+func TestUnTarFromWithinLimits(t *testing.T) {
+	archive := tarOf(t, entry{name: "a/b", data: "abc"}, entry{name: "c", data: "de"})
+	limits := UnTarLimits{MaxBytes: 5, MaxEntries: 2, MaxDepth: 2}
+	if err := UnTarFrom(archive, t.TempDir(), limits); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnTarFromExistingSymlink(t *testing.T) {
+	base := t.TempDir()
+	dst := filepath.Join(base, "dst")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{dst, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink(t, outside, filepath.Join(dst, "out"))
+
+	tests := []struct {
+		name  string
+		entry entry
+	}{
+		{name: "file through symlink", entry: entry{name: "out/f", data: "x"}},
+		{name: "symlink through symlink", entry: entry{name: "s", typ: tar.TypeSymlink, link: "out/f"}},
+		{name: "directory over symlink", entry: entry{name: "out/", typ: tar.TypeDir}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := UnTarFrom(tarOf(t, test.entry), dst, DefaultUnTarLimits); !errors.Is(err, ErrUnsafeEntry) {
+				t.Fatalf("UnTarFrom = %v, want %v", err, ErrUnsafeEntry)
+			}
+		})
+	}
+	info, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Fatalf("mode of the symlink target changed to %v", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("%d entries written through the symlink", len(entries))
+	}
+}
+
+func TestEntryPath(t *testing.T) {
+	dst := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dst, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, "d", filepath.Join(dst, "s"))
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		want     string
+		err      error
+	}{
+		{name: "f", want: "f"},
+		{name: "d/f", want: "d/f"},
+		{name: "./d/./f", want: "d/f"},
+		{name: "d/../f", want: "f"},
+		{name: "s", want: "s"},
+		{name: "a/b/c", maxDepth: 3, want: "a/b/c"},
+		{name: "a/b/c", maxDepth: 2, err: ErrLimitExceeded},
+		{name: "../f", err: ErrUnsafeEntry},
+		{name: "d/../../f", err: ErrUnsafeEntry},
+		{name: "/f", err: ErrUnsafeEntry},
+		{name: "s/f", err: ErrUnsafeEntry},
+	}
+	for _, test := range tests {
+		got, err := EntryPath(dst, test.name, test.maxDepth)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("EntryPath(%q) = %q, %v, want %v", test.name, got, err, test.err)
+			}
+			continue
+		}
+		if want := filepath.Join(dst, filepath.FromSlash(test.want)); err != nil || got != want {
+			t.Errorf("EntryPath(%q) = %q, %v, want %q", test.name, got, err, want)
+		}
+	}
+
+	// the name alone does not pass through the symlink
+	if got, err := CleanEntryPath(dst, "s/f", 0); err != nil || got != filepath.Join(dst, "s", "f") {
+		t.Errorf("CleanEntryPath(%q) = %q, %v", "s/f", got, err)
+	}
+}
+
+func TestCheckSymlink(t *testing.T) {
+	base := t.TempDir()
+	dst := filepath.Join(base, "dst")
+	for _, dir := range []string{filepath.Join(dst, "a", "b"), filepath.Join(base, "outside")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink(t, "a", filepath.Join(dst, "in"))
+	symlink(t, filepath.Join(base, "outside"), filepath.Join(dst, "out"))
+
+	tests := []struct {
+		path string
+		link string
+		ok   bool
+	}{
+		{path: "l", link: "a/b", ok: true},
+		{path: "a/l", link: "../in/b", ok: true},
+		{path: "a/b/l", link: "../../a", ok: true},
+		{path: "l", link: "in", ok: true},
+		{path: "l", link: "missing/x", ok: true},
+		{path: "l", link: "..", ok: false},
+		{path: "a/l", link: "../..", ok: false},
+		{path: "l", link: "/etc", ok: false},
+		{path: "l", link: "a/..", ok: false},
+		{path: "l", link: "in/../..", ok: false},
+		{path: "l", link: "out", ok: false},
+		{path: "l", link: "out/x", ok: false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dst, filepath.FromSlash(test.path))
+		err := CheckSymlink(dst, path, test.path, test.link)
+		if test.ok != (err == nil) || (err != nil && !errors.Is(err, ErrUnsafeEntry)) {
+			t.Errorf("CheckSymlink(%q -> %q) = %v, want ok %v", test.path, test.link, err, test.ok)
+		}
+	}
+
+	// the target alone does not follow the symlink out
+	if err := CheckSymlinkTarget(dst, filepath.Join(dst, "l"), "l", "out/x"); err != nil {
+		t.Errorf("CheckSymlinkTarget(%q -> %q) = %v", "l", "out/x", err)
+	}
+	if err := CheckSymlinkTarget(dst, filepath.Join(dst, "l"), "l", "a/.."); !errors.Is(err, ErrUnsafeEntry) {
+		t.Errorf("CheckSymlinkTarget(%q -> %q) = %v, want %v", "l", "a/..", err, ErrUnsafeEntry)
+	}
+}
+
+func TestMergeDir(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	dst := filepath.Join(base, "dst")
+	files := map[string]string{
+		"src/f":   "new",
+		"src/d/g": "new",
+		"src/n/h": "new",
+		"dst/f":   "old",
+		"dst/d/g": "old",
+		"dst/k":   "kept",
+	}
+	for name, data := range files {
+		p := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := MergeDir(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"f": "new", "d/g": "new", "n/h": "new", "k": "kept"} {
+		data, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestMergeDirRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, dst string, outside string)
+	}{
+		{name: "directory is a symlink", prepare: func(t *testing.T, dst string, outside string) {
+			symlink(t, outside, filepath.Join(dst, "d"))
+		}},
+		{name: "directory is a file", prepare: func(t *testing.T, dst string, outside string) {
+			if err := os.WriteFile(filepath.Join(dst, "d"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+			src, dst, outside := filepath.Join(base, "src"), filepath.Join(base, "dst"), filepath.Join(base, "outside")
+			for _, dir := range []string{filepath.Join(src, "d"), dst, outside} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(src, "d", "f"), []byte("x"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			test.prepare(t, dst, outside)
+			err := MergeDir(src, dst)
+			if !errors.Is(err, ErrUnsafeEntry) || !strings.Contains(err.Error(), "not a directory") {
+				t.Fatalf("MergeDir = %v, want %v", err, ErrUnsafeEntry)
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "f")); err == nil {
+				t.Fatal("a file was written through the symlink")
+			}
+		})
+	}
+}